@@ -44,7 +44,7 @@ func (c *Cache) Get(s utils.Service) ([]utils.Entry, error) {
 	return c.lru.Get(s)
 }
 
-// Add adds a value to the cache.  Returns true if an eviction occurred.
+// Add adds a value to the cache.  Returns false if nothing was stored.
 func (c *Cache) Add(s utils.Service) bool {
 	c.lock.Lock()
 	defer c.lock.Unlock()
@@ -101,6 +101,27 @@ func (c *Cache) Containkey(name string) bool {
 	return c.lru.Containkey(name)
 }
 
+// ContainName judge whether domain or a name below it is in the cache
+func (c *Cache) ContainName(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lru.ContainName(name)
+}
+
+// GetReverse returns the A and AAAA records whose address reverses to name
+func (c *Cache) GetReverse(name string) []utils.Entry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lru.GetReverse(name)
+}
+
+// ContainReverse judge whether an address reverses to name or below it
+func (c *Cache) ContainReverse(name string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.lru.ContainReverse(name)
+}
+
 func (c *Cache) Contains(name string, rt string) bool {
 	c.lock.RLock()
 	defer c.lock.RUnlock()
@@ -15,14 +15,14 @@ func TestLRU(t *testing.T) {
 	if err != nil {
 		t.Errorf("fail to create LRU")
 	}
-	l.Add(utils.Service{"A", "10.0.0.0", 600, "www.google.com"})
-	l.Get(utils.Service{"A", "", 0, "www.google.com"})
-	l.Remove(utils.Service{"A", "", 0, "www.google.com"})
-	l.Get(utils.Service{"A", "", 0, "www.google.com"})
-	if tmp, _ := l.Get(utils.Service{"MX", "", 0, "www.google.com"}); len(tmp) != 0 {
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Get(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
+	l.Get(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
+	if tmp, _ := l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 0, Aliases: "www.google.com"}); len(tmp) != 0 {
 		t.Errorf("not get nil")
 	}
-	if tmp, _ := l.Get(utils.Service{"MX", "", 0, "www.taobao.com"}); len(tmp) != 0 {
+	if tmp, _ := l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 0, Aliases: "www.taobao.com"}); len(tmp) != 0 {
 		t.Errorf("not get nil")
 	}
 	fmt.Println(l.Keys())
@@ -30,42 +30,42 @@ func TestLRU(t *testing.T) {
 	l.Purge()
 	fmt.Println(l.Keys())
 	fmt.Println(l.Len())
-	l.Add(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"MX", "www.baidu.com", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "12.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "MX", Value: "www.baidu.com", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "12.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println(l.Keys())
 	fmt.Println(l.Len())
-	l.Set(utils.Service{"A", "10.0.0.0", 500, "www.google.com"}, utils.Service{"A", "10.0.0.1", 500, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.2", 600, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.3", 600, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.4", 600, "www.google.com"})
-	if result := l.Set(utils.Service{"A", "10.0.0.4", 600, "www.renren.com"},
-		utils.Service{"A", "10.0.0.5", 600, "www.google.com"}); result == nil {
+	l.Set(utils.Service{RecordType: "A", Value: "10.0.0.0", TTL: 500, Aliases: "www.google.com"}, utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 500, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.2", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.3", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.google.com"})
+	if result := l.Set(utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.renren.com"},
+		utils.Service{RecordType: "A", Value: "10.0.0.5", TTL: 600, Aliases: "www.google.com"}); result == nil {
 		t.Errorf("not get nil")
 	}
-	if result := l.Set(utils.Service{"MX", "10.0.0.4", 600, "www.google.com"},
-		utils.Service{"MX", "10.0.0.5", 600, "www.google.com"}); result == nil {
+	if result := l.Set(utils.Service{RecordType: "MX", Value: "10.0.0.4", TTL: 600, Aliases: "www.google.com"},
+		utils.Service{RecordType: "MX", Value: "10.0.0.5", TTL: 600, Aliases: "www.google.com"}); result == nil {
 		t.Errorf("not get nil")
 	}
-	if result := l.Set(utils.Service{"A", "10.0.0.10", 600, "www.google.com"},
-		utils.Service{"A", "10.0.0.5", 600, "www.google.com"}); result == nil {
+	if result := l.Set(utils.Service{RecordType: "A", Value: "10.0.0.10", TTL: 600, Aliases: "www.google.com"},
+		utils.Service{RecordType: "A", Value: "10.0.0.5", TTL: 600, Aliases: "www.google.com"}); result == nil {
 		t.Errorf("not get nil")
 	}
-	l.Add(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println("1")
-	l.Remove(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"MX", "www.baidu.com", 600, "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "MX", Value: "www.baidu.com", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println("2")
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println("3")
-	l.Add(utils.Service{"MX", "12.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "12.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println("4")
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	if !l.Containkey("www.google.com") {
 		t.Errorf("should contain")
 	}
@@ -74,12 +74,12 @@ func TestLRU(t *testing.T) {
 	}
 	fmt.Println("5")
 	l.Purge()
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.oschina.com"})
-	if result := l.Set(utils.Service{"MX", "13.0.0.0", 600, "www.oschina.com"},
-		utils.Service{"MX", "13.0.0.1", 600, "www.oschina.com"}); result != nil {
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.oschina.com"})
+	if result := l.Set(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.oschina.com"},
+		utils.Service{RecordType: "MX", Value: "13.0.0.1", TTL: 600, Aliases: "www.oschina.com"}); result != nil {
 		t.Errorf("should get nil")
 	}
-	fmt.Println(l.Get(utils.Service{"MX", "", 600, "www.oschina.com"}))
+	fmt.Println(l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 600, Aliases: "www.oschina.com"}))
 	l.RemoveOldest()
 	_, err = New(3)
 	if err != nil {
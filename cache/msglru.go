@@ -1,10 +1,12 @@
 package cache
 
 import (
+	"errors"
 	"github.com/hawkingrei/g53/cache/simplemsglru"
 	"github.com/miekg/dns"
 	"github.com/spaolacci/murmur3"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,10 +21,23 @@ func Round(val float64) uint32 {
 	return uint32(val + 0.5)
 }
 
+// DefaultShards is the number of independently locked shards of a MsgCache
+const DefaultShards = 256
+
+// sweepBatch is the number of entries a sweep looks at per shard, to hold
+// the lock of a shard briefly.
+const sweepBatch = 64
+
 // Cache is a thread-safe fixed size LRU cache.
 type MsgCache struct {
-	lru  [256]*simplemsglru.LRU
-	lock [256]sync.RWMutex
+	// expired and expiredBytes count what the sweeps removed
+	expired      uint64
+	expiredBytes uint64
+
+	lru       []*simplemsglru.LRU
+	lock      []sync.RWMutex
+	sweepLock sync.Mutex
+	stopSweep chan struct{}
 }
 
 // New creates an LRU of the given size
@@ -32,10 +47,30 @@ func NewMsgCache(size int) (*MsgCache, error) {
 
 // NewWithEvict constructs a fixed size cache with the given eviction
 // callback.
-func NewMsgCacheWithEvict(size int, onEvicted func(s *[]dns.RR)) (c *MsgCache, err error) {
-	c = new(MsgCache)
-	for i := 0; i < 256; i++ {
-		c.lru[i], err = simplemsglru.NewLRU(size/256, simplemsglru.EvictCallback(onEvicted))
+func NewMsgCacheWithEvict(size int, onEvicted func(e *simplemsglru.Entry)) (c *MsgCache, err error) {
+	return NewShardedMsgCache(size, 0, DefaultShards, simplemsglru.PolicyLRU, onEvicted)
+}
+
+// NewShardedMsgCache constructs a cache of size entries whose responses
+// take at most maxBytes in wire format, 0 only bounds the number of entries.
+// It is split across shards LRUs holding an equal part of both, evicting
+// the entries the policy called policy picks.
+func NewShardedMsgCache(size int, maxBytes int64, shards int, policy string, onEvicted func(e *simplemsglru.Entry)) (c *MsgCache, err error) {
+	if shards <= 0 {
+		return nil, errors.New("Must provide a positive number of shards")
+	}
+	c = &MsgCache{
+		lru:  make([]*simplemsglru.LRU, shards),
+		lock: make([]sync.RWMutex, shards),
+	}
+	for i := 0; i < shards; i++ {
+		shardSize := (size + shards - 1) / shards
+		shardBytes := int((maxBytes + int64(shards) - 1) / int64(shards))
+		shardPolicy, err := simplemsglru.NewPolicy(policy, shardSize)
+		if err != nil {
+			return nil, err
+		}
+		c.lru[i], err = simplemsglru.NewPolicyLRU(shardSize, shardBytes, shardPolicy, simplemsglru.EvictCallback(onEvicted))
 		if err != nil {
 			return nil, err
 		}
@@ -43,9 +78,14 @@ func NewMsgCacheWithEvict(size int, onEvicted func(s *[]dns.RR)) (c *MsgCache, e
 	return c, nil
 }
 
+// segment returns the shard holding key
+func (c *MsgCache) segment(key simplemsglru.Key) uint64 {
+	return hashFunc([]byte(key.Name)) % uint64(len(c.lru))
+}
+
 // Purge is used to completely clear the cache
 func (c *MsgCache) Purge() {
-	for i := 0; i < 256; i++ {
+	for i := range c.lru {
 		c.lock[i].Lock()
 		c.lru[i].Purge()
 		c.lock[i].Unlock()
@@ -53,26 +93,41 @@ func (c *MsgCache) Purge() {
 }
 
 // Get looks up a key's value from the cache.
-func (c *MsgCache) Get(name string, rtype uint16) ([]dns.RR, *time.Time, error) {
-	hashVal := hashFunc([]byte(name))
-	segId := hashVal & 255
+func (c *MsgCache) Get(key simplemsglru.Key) (simplemsglru.Entry, error) {
+	segId := c.segment(key)
 	c.lock[segId].Lock()
 	defer c.lock[segId].Unlock()
-	return c.lru[segId].Get(name, rtype)
+	return c.lru[segId].Get(key)
+}
+
+// Peek looks up a key's value and its hits without counting a hit.
+func (c *MsgCache) Peek(key simplemsglru.Key) (simplemsglru.Entry, error) {
+	segId := c.segment(key)
+	c.lock[segId].RLock()
+	defer c.lock[segId].RUnlock()
+	return c.lru[segId].Peek(key)
 }
 
-// Add adds a value to the cache.  Returns true if an eviction occurred.
-func (c *MsgCache) Add(s []dns.RR, rtype uint16) bool {
-	hashVal := hashFunc([]byte(s[0].Header().Name))
-	segId := hashVal & 255
+// MarkPrefetched flags the response under key as being refreshed, it
+// returns false if it already was.
+func (c *MsgCache) MarkPrefetched(key simplemsglru.Key) bool {
+	segId := c.segment(key)
 	c.lock[segId].Lock()
 	defer c.lock[segId].Unlock()
-	return c.lru[segId].Add(s, rtype)
+	return c.lru[segId].MarkPrefetched(key)
+}
+
+// Add adds the response m under key.  Returns true if an eviction occurred.
+func (c *MsgCache) Add(key simplemsglru.Key, m *dns.Msg) bool {
+	segId := c.segment(key)
+	c.lock[segId].Lock()
+	defer c.lock[segId].Unlock()
+	return c.lru[segId].Add(key, m)
 }
 
 // Keys returns a slice of the keys in the cache, from oldest to newest.
-func (c *MsgCache) Keys() (result []interface{}) {
-	for i := 0; i < 256; i++ {
+func (c *MsgCache) Keys() (result []simplemsglru.Key) {
+	for i := range c.lru {
 		c.lock[i].RLock()
 		result = append(result, c.lru[i].Keys()...)
 		c.lock[i].RUnlock()
@@ -82,7 +137,7 @@ func (c *MsgCache) Keys() (result []interface{}) {
 
 // Len returns the number of items in the cache.
 func (c *MsgCache) Len() (result int) {
-	for i := 0; i < 256; i++ {
+	for i := range c.lru {
 		c.lock[i].RLock()
 		result = result + c.lru[i].Len()
 		c.lock[i].RUnlock()
@@ -90,10 +145,80 @@ func (c *MsgCache) Len() (result int) {
 	return result
 }
 
-func (c *MsgCache) Remove(name string, rtype uint16) error {
-	hashVal := hashFunc([]byte(name))
-	segId := hashVal & 255
+// Bytes returns the size of the responses in the cache in wire format.
+func (c *MsgCache) Bytes() (result int64) {
+	for i := range c.lru {
+		c.lock[i].RLock()
+		result = result + int64(c.lru[i].Bytes())
+		c.lock[i].RUnlock()
+	}
+	return result
+}
+
+// Evictions returns the number of entries evicted to make room for others.
+func (c *MsgCache) Evictions() (result uint64) {
+	for i := range c.lru {
+		c.lock[i].RLock()
+		result = result + c.lru[i].Evictions()
+		c.lock[i].RUnlock()
+	}
+	return result
+}
+
+// Sweep removes the entries expired longer than window ago, looking at the
+// next batch of entries of every shard in turn.
+func (c *MsgCache) Sweep(window time.Duration) {
+	for i := range c.lru {
+		c.lock[i].Lock()
+		removed, bytes := c.lru[i].RemoveExpired(time.Now(), window, sweepBatch)
+		c.lock[i].Unlock()
+		atomic.AddUint64(&c.expired, uint64(removed))
+		atomic.AddUint64(&c.expiredBytes, uint64(bytes))
+	}
+}
+
+// StartSweeping sweeps the cache every interval in background, see Sweep.
+func (c *MsgCache) StartSweeping(interval time.Duration, window time.Duration) {
+	c.sweepLock.Lock()
+	if c.stopSweep != nil || interval <= 0 {
+		c.sweepLock.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	c.stopSweep = stop
+	c.sweepLock.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.Sweep(window)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopSweeping stops the sweeps started by StartSweeping
+func (c *MsgCache) StopSweeping() {
+	c.sweepLock.Lock()
+	defer c.sweepLock.Unlock()
+	if c.stopSweep != nil {
+		close(c.stopSweep)
+		c.stopSweep = nil
+	}
+}
+
+// Expired returns the number of entries and bytes the sweeps removed.
+func (c *MsgCache) Expired() (entries uint64, bytes uint64) {
+	return atomic.LoadUint64(&c.expired), atomic.LoadUint64(&c.expiredBytes)
+}
+
+func (c *MsgCache) Remove(key simplemsglru.Key) error {
+	segId := c.segment(key)
 	c.lock[segId].Lock()
 	defer c.lock[segId].Unlock()
-	return c.lru[segId].Remove(name, rtype)
+	return c.lru[segId].Remove(key)
 }
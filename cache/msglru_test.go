@@ -1,12 +1,15 @@
 package cache
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/hawkingrei/g53/cache/simplemsglru"
 	"github.com/miekg/dns"
 	"testing"
+	"time"
 )
 
-func getmsg(name string, rtype uint16) dns.Msg {
+func getmsg(name string, rtype uint16) *dns.Msg {
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = true
@@ -14,33 +17,105 @@ func getmsg(name string, rtype uint16) dns.Msg {
 	m1.Question[0] = dns.Question{name, rtype, dns.ClassINET}
 	c := new(dns.Client)
 	in, _, _ := c.Exchange(m1, "8.8.8.8:53")
-	return *in
+	return in
+}
+
+func key(name string, rtype uint16) simplemsglru.Key {
+	return simplemsglru.Key{Name: name, Qtype: rtype, Qclass: dns.ClassINET}
 }
 
 func TestMsgLRU(t *testing.T) {
-	_, err := NewMsgCacheWithEvict(0, func(s *[]dns.RR) { fmt.Println(*s) })
+	_, err := NewMsgCacheWithEvict(0, func(e *simplemsglru.Entry) { fmt.Println(e.Key) })
 	if err == nil {
 		t.Errorf("should get a error")
 	}
-	l, err := NewMsgCacheWithEvict(256*1, func(s *[]dns.RR) { fmt.Println(*s) })
+	l, err := NewMsgCacheWithEvict(256*1, func(e *simplemsglru.Entry) { fmt.Println(e.Key) })
 	if err != nil {
 		t.Errorf("fail to create LRU")
 	}
-	l.Add(getmsg("www.baidu.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.renren.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.taobao.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.weibo.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.qq.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.sohu.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.tmall.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.jd.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.hao123.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.csdn.net.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.soso.com.", dns.TypeA).Answer, dns.TypeA)
-
-	fmt.Println(l.Get("www.baidu.com.", dns.TypeA))
-	fmt.Println(l.Get("www.weibo.com.", dns.TypeA))
+	l.Add(key("www.baidu.com.", dns.TypeA), getmsg("www.baidu.com.", dns.TypeA))
+	l.Add(key("www.renren.com.", dns.TypeA), getmsg("www.renren.com.", dns.TypeA))
+	l.Add(key("www.taobao.com.", dns.TypeA), getmsg("www.taobao.com.", dns.TypeA))
+	l.Add(key("www.weibo.com.", dns.TypeA), getmsg("www.weibo.com.", dns.TypeA))
+	l.Add(key("www.qq.com.", dns.TypeA), getmsg("www.qq.com.", dns.TypeA))
+	l.Add(key("www.sohu.com.", dns.TypeA), getmsg("www.sohu.com.", dns.TypeA))
+	l.Add(key("www.tmall.com.", dns.TypeA), getmsg("www.tmall.com.", dns.TypeA))
+	l.Add(key("www.jd.com.", dns.TypeA), getmsg("www.jd.com.", dns.TypeA))
+	l.Add(key("www.hao123.com.", dns.TypeA), getmsg("www.hao123.com.", dns.TypeA))
+	l.Add(key("www.csdn.net.", dns.TypeA), getmsg("www.csdn.net.", dns.TypeA))
+	l.Add(key("www.soso.com.", dns.TypeA), getmsg("www.soso.com.", dns.TypeA))
+
+	fmt.Println(l.Get(key("www.baidu.com.", dns.TypeA)))
+	fmt.Println(l.Get(key("www.weibo.com.", dns.TypeA)))
 	fmt.Println(l.Len())
 	fmt.Println(l.Keys())
 	l.Purge()
 }
+
+func TestShardedMsgCache(t *testing.T) {
+	if _, err := NewShardedMsgCache(16, 0, 0, simplemsglru.PolicyLRU, nil); err == nil {
+		t.Error("should get a error")
+	}
+	if _, err := NewShardedMsgCache(16, 0, 4, "mru", nil); err == nil {
+		t.Error("should get a error")
+	}
+	l, err := NewShardedMsgCache(16, 0, 4, simplemsglru.PolicyLRU, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 64; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion(fmt.Sprintf("www%d.example.com.", i), dns.TypeA)
+		l.Add(simplemsglru.NewKey(m), m)
+	}
+	if l.Len() != 16 {
+		t.Error("Expected 16 entries, got", l.Len())
+	}
+}
+
+func TestMsgCacheSweep(t *testing.T) {
+	l, _ := NewShardedMsgCache(64, 0, 4, simplemsglru.PolicyLRU, nil)
+	for i := 0; i < 8; i++ {
+		m := new(dns.Msg)
+		name := fmt.Sprintf("www%d.example.com.", i)
+		m.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 1 IN A 192.0.2.1")
+		m.Answer = []dns.RR{rr}
+		l.Add(simplemsglru.NewKey(m), m)
+	}
+	size := l.Bytes()
+	l.StartSweeping(10*time.Millisecond, 0)
+	defer l.StopSweeping()
+	time.Sleep(100 * time.Millisecond)
+	if entries, bytes := l.Expired(); l.Len() != 0 || entries != 8 || int64(bytes) != size {
+		t.Error("Expected the expired entries to be swept, got", l.Len(), "entries left,", entries, bytes, "removed")
+	}
+}
+
+func TestMsgCacheSnapshot(t *testing.T) {
+	l, _ := NewMsgCache(256)
+	for name, ttl := range map[string]int{"fresh.example.com.": 300, "expired.example.com.": 1} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A 192.0.2.1", name, ttl))
+		m.Answer = []dns.RR{rr}
+		l.Add(simplemsglru.NewKey(m), m)
+	}
+	var buf bytes.Buffer
+	if saved, err := l.Save(&buf); err != nil || saved != 2 {
+		t.Fatal("Expected 2 answers saved, got", saved, err)
+	}
+
+	restored, _ := NewMsgCache(256)
+	if loaded, err := restored.Load(&buf); err != nil || loaded != 1 {
+		t.Fatal("Expected the fresh answer loaded, got", loaded, err)
+	}
+	original, _ := l.Peek(key("fresh.example.com.", dns.TypeA))
+	entry, err := restored.Peek(key("fresh.example.com.", dns.TypeA))
+	if err != nil || !entry.Time.Equal(original.Time) || entry.Msg.Answer[0].String() != original.Msg.Answer[0].String() {
+		t.Error("Expected the answer with its insert time, got", entry, err)
+	}
+	if _, err := restored.Load(bytes.NewBufferString("garbage")); err == nil {
+		t.Error("should get a error")
+	}
+}
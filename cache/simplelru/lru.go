@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
 	"reflect"
 	"time"
 )
@@ -23,6 +24,13 @@ type LRU struct {
 	evictList *list.List
 	items     map[interface{}]*Records
 	onEvict   EvictCallback
+	// names counts the names stored at or below each name, so that empty
+	// non-terminals are found without a scan.
+	names map[string]int
+	// addrs holds the A and AAAA records by the reverse name of their
+	// address, reverse counts the addresses at or below each reverse name.
+	addrs   map[string][]*list.Element
+	reverse map[string]int
 }
 
 func NewLRU(size int, onEvict EvictCallback) (*LRU, error) {
@@ -34,6 +42,9 @@ func NewLRU(size int, onEvict EvictCallback) (*LRU, error) {
 		evictList: list.New(),
 		items:     make(map[interface{}]*Records),
 		onEvict:   onEvict,
+		names:     make(map[string]int),
+		addrs:     make(map[string][]*list.Element),
+		reverse:   make(map[string]int),
 	}
 	return c, nil
 }
@@ -46,6 +57,9 @@ func (c *LRU) Purge() {
 		}
 	}
 	c.items = make(map[interface{}]*Records)
+	c.names = make(map[string]int)
+	c.addrs = make(map[string][]*list.Element)
+	c.reverse = make(map[string]int)
 	c.evictList.Init()
 }
 
@@ -60,9 +74,11 @@ func (c *LRU) Set(originalValue utils.Service, modifyValue utils.Service) error
 		}
 		for v := range tmp.list {
 			if reflect.DeepEqual(originalValue.Value, tmp.list[v].Value.(*utils.Entry).Value) {
+				c.unindexAddr(tmp.list[v])
 				tmp.list[v].Value.(*utils.Entry).TTL = modifyValue.TTL
 				tmp.list[v].Value.(*utils.Entry).Time = time.Now()
 				tmp.list[v].Value.(*utils.Entry).Value = modifyValue.Value
+				c.indexAddr(tmp.list[v])
 				return nil
 			}
 		}
@@ -70,10 +86,28 @@ func (c *LRU) Set(originalValue utils.Service, modifyValue utils.Service) error
 	return errors.New("don't Exist service ")
 }
 
-// Add adds a value to the cache.  Returns true if an eviction occurred.
+// Add adds a value to the cache, evicting the oldest one when it is full.
+// A value with the same type and data as a cached one only updates its TTL.
+// Returns false if nothing was changed: the value is already in the cache,
+// or it is a CNAME next to A or AAAA records.
 func (c *LRU) Add(s utils.Service) bool {
 	if elements := c.items[s.Aliases]; elements != nil {
-		if element := elements.table[s.RecordType]; element == nil {
+		if element := elements.table[s.RecordType]; element != nil {
+			for _, elem := range element.list {
+				entry := elem.Value.(*utils.Entry)
+				stored := utils.EntryToServer(entry)
+				stored.TTL = s.TTL
+				if stored != s {
+					continue
+				}
+				if entry.TTL == s.TTL {
+					return false
+				}
+				entry.TTL = s.TTL
+				entry.Time = time.Now()
+				return true
+			}
+		} else {
 			if len(elements.table) == 0 {
 				Records := &Record{make([]*list.Element, 0)}
 				elements.table[s.RecordType] = Records
@@ -88,17 +122,18 @@ func (c *LRU) Add(s utils.Service) bool {
 				}
 			}
 		}
-		content := &utils.Entry{s.RecordType, s.Value, s.TTL, s.Aliases, time.Now()}
-		elements.table[s.RecordType].list = append(elements.table[s.RecordType].list, c.evictList.PushFront(content))
+		content := utils.NewEntry(s)
+		elem := c.evictList.PushFront(content)
+		elements.table[s.RecordType].list = append(elements.table[s.RecordType].list, elem)
+		c.indexAddr(elem)
 		c.size = c.size + 1
 	} else {
 		c.addNew(s)
 	}
-	evict := c.evictList.Len() > c.size
-	if evict {
+	if c.evictList.Len() > c.size {
 		c.RemoveOldest()
 	}
-	return evict
+	return true
 }
 
 // Get looks up a key's value from the cache.
@@ -118,6 +153,21 @@ func (c *LRU) Get(s utils.Service) ([]utils.Entry, error) {
 	return result, nil
 }
 
+// GetReverse returns the A and AAAA records whose address reverses to name.
+func (c *LRU) GetReverse(name string) []utils.Entry {
+	result := []utils.Entry{}
+	for _, elem := range c.addrs[name] {
+		result = append(result, utils.EntryPointerToEntry(elem.Value.(*utils.Entry)))
+	}
+	return result
+}
+
+// ContainReverse checks whether the address of an A or AAAA record reverses
+// to name or to a name below it.
+func (c *LRU) ContainReverse(name string) bool {
+	return c.reverse[name] > 0
+}
+
 // Check if a key is in the cache, without updating the recent-ness
 // or deleting it for being stale.
 func (c *LRU) Containkey(key interface{}) (ok bool) {
@@ -125,6 +175,11 @@ func (c *LRU) Containkey(key interface{}) (ok bool) {
 	return ok
 }
 
+// ContainName checks whether key or a name below it is in the cache.
+func (c *LRU) ContainName(key string) bool {
+	return c.names[key] > 0
+}
+
 func (c *LRU) Contains(key interface{}, rt string) (ok bool) {
 	_, ok = c.items[key]
 	if ok {
@@ -148,10 +203,15 @@ func (c *LRU) RemoveOldest() {
 			del.list = append(del.list[:v], del.list[v+1:]...)
 			if len(del.list) == 0 {
 				delete(delValue.table, delElem.Value.(*utils.Entry).RecordType)
+				if len(delValue.table) == 0 {
+					delete(c.items, delElem.Value.(*utils.Entry).Aliases)
+					c.indexName(delElem.Value.(*utils.Entry).Aliases, -1)
+				}
 			}
 			break
 		}
 	}
+	c.unindexAddr(delElem)
 	c.evictList.Remove(delElem)
 }
 
@@ -172,12 +232,15 @@ func (c *LRU) Len() int {
 }
 
 func (c *LRU) addNew(s utils.Service) {
-	entries := &utils.Entry{s.RecordType, s.Value, s.TTL, s.Aliases, time.Now()}
+	entries := utils.NewEntry(s)
 	newRecord := &Record{make([]*list.Element, 0)}
-	(*newRecord).list = append((*newRecord).list, c.evictList.PushFront(entries))
+	elem := c.evictList.PushFront(entries)
+	(*newRecord).list = append((*newRecord).list, elem)
+	c.indexAddr(elem)
 	newRecords := &Records{table: make(map[interface{}]*Record)}
 	newRecords.table[s.RecordType] = newRecord
 	c.items[s.Aliases] = newRecords
+	c.indexName(s.Aliases, 1)
 }
 
 // removeElement is used to remove a given list element from the cache
@@ -193,16 +256,24 @@ func (c *LRU) Remove(s utils.Service) error {
 				if c.onEvict != nil {
 					c.onEvict(tmp[v].Value.(*utils.Entry))
 				}
+				c.unindexAddr(tmp[v])
 				c.evictList.Remove(tmp[v])
 				tmp = append(tmp[:v], tmp[v+1:]...)
 				v = v - 1
 				removeNum = removeNum + 1
 				if len(tmp) == 0 {
 					delete(element.table, s.RecordType)
+					if len(element.table) == 0 {
+						delete(c.items, s.Aliases)
+						c.indexName(s.Aliases, -1)
+					}
 				}
 
 			}
 		}
+		if record, ok := element.table[s.RecordType]; ok {
+			record.list = tmp
+		}
 	}
 	if removeNum > 0 {
 		return nil
@@ -223,3 +294,58 @@ func (c *LRU) List() []utils.Service {
 	}
 	return result
 }
+
+// indexName counts the stored name key at key and at each of its ancestors
+func (c *LRU) indexName(key string, delta int) {
+	for off, end := 0, false; !end; off, end = dns.NextLabel(key, off) {
+		if c.names[key[off:]] += delta; c.names[key[off:]] <= 0 {
+			delete(c.names, key[off:])
+		}
+	}
+}
+
+// reverseName returns the reverse name of the address of an A or AAAA record
+func reverseName(entry *utils.Entry) (string, bool) {
+	if entry.RecordType != "A" && entry.RecordType != "AAAA" {
+		return "", false
+	}
+	name, err := dns.ReverseAddr(entry.Value)
+	return name, err == nil
+}
+
+// indexAddr records the address of elem, when it is an A or AAAA record
+func (c *LRU) indexAddr(elem *list.Element) {
+	name, ok := reverseName(elem.Value.(*utils.Entry))
+	if !ok {
+		return
+	}
+	c.addrs[name] = append(c.addrs[name], elem)
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		c.reverse[name[off:]]++
+	}
+}
+
+// unindexAddr forgets the address of elem recorded by indexAddr
+func (c *LRU) unindexAddr(elem *list.Element) {
+	name, ok := reverseName(elem.Value.(*utils.Entry))
+	if !ok {
+		return
+	}
+	elems := c.addrs[name]
+	for i := range elems {
+		if elems[i] != elem {
+			continue
+		}
+		if len(elems) == 1 {
+			delete(c.addrs, name)
+		} else {
+			c.addrs[name] = append(elems[:i], elems[i+1:]...)
+		}
+		for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+			if c.reverse[name[off:]]--; c.reverse[name[off:]] == 0 {
+				delete(c.reverse, name[off:])
+			}
+		}
+		return
+	}
+}
@@ -15,17 +15,17 @@ func TestSimleLRU(t *testing.T) {
 	if err != nil {
 		t.Errorf("fail to create LRU")
 	}
-	l.Add(utils.Service{"A", "10.0.0.0", 600, "www.google.com"})
-	l.Get(utils.Service{"A", "", 0, "www.google.com"})
-	l.Remove(utils.Service{"A", "", 0, "www.google.com"})
-	l.Get(utils.Service{"A", "", 0, "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Get(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
+	l.Get(utils.Service{RecordType: "A", Value: "", TTL: 0, Aliases: "www.google.com"})
 	fmt.Println(l.Containkey("www.google.com"))
 	fmt.Println(l.Contains("www.google.com", "A"))
 	fmt.Println(l.Contains("www.google.com", "AAAA"))
-	if tmp, _ := l.Get(utils.Service{"MX", "", 0, "www.google.com"}); len(tmp) != 0 {
+	if tmp, _ := l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 0, Aliases: "www.google.com"}); len(tmp) != 0 {
 		t.Errorf("not get nil")
 	}
-	if tmp, _ := l.Get(utils.Service{"MX", "", 0, "www.taobao.com"}); len(tmp) != 0 {
+	if tmp, _ := l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 0, Aliases: "www.taobao.com"}); len(tmp) != 0 {
 		t.Errorf("not get nil")
 	}
 	fmt.Println(l.Keys())
@@ -33,48 +33,114 @@ func TestSimleLRU(t *testing.T) {
 	l.Purge()
 	fmt.Println(l.Keys())
 	fmt.Println(l.Len())
-	l.Add(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"MX", "www.baidu.com", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "MX", Value: "www.baidu.com", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println(l.List())
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "12.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "12.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println(l.Keys())
 	fmt.Println(l.Len())
-	l.Set(utils.Service{"A", "10.0.0.0", 500, "www.google.com"}, utils.Service{"A", "10.0.0.1", 500, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.2", 600, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.3", 600, "www.google.com"})
-	l.Add(utils.Service{"A", "10.0.0.4", 600, "www.google.com"})
-	if result := l.Set(utils.Service{"A", "10.0.0.4", 600, "www.google.com"}, utils.Service{"A", "12.0.0.1", 600, "www.google.com"}); result != nil {
+	l.Set(utils.Service{RecordType: "A", Value: "10.0.0.0", TTL: 500, Aliases: "www.google.com"}, utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 500, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.2", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.3", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.google.com"})
+	if result := l.Set(utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.google.com"}, utils.Service{RecordType: "A", Value: "12.0.0.1", TTL: 600, Aliases: "www.google.com"}); result != nil {
 		t.Errorf("should be nil")
 	}
-	if result := l.Set(utils.Service{"A", "10.0.0.4", 600, "www.renren.com"},
-		utils.Service{"A", "10.0.0.4", 600, "www.renren.com"}); result == nil {
+	if result := l.Set(utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.renren.com"},
+		utils.Service{RecordType: "A", Value: "10.0.0.4", TTL: 600, Aliases: "www.renren.com"}); result == nil {
 		t.Errorf("not get nil")
 	}
-	if result := l.Set(utils.Service{"A", "12.0.0.10", 600, "www.google.com"},
-		utils.Service{"A", "12.0.0.5", 600, "www.google.com"}); result == nil {
+	if result := l.Set(utils.Service{RecordType: "A", Value: "12.0.0.10", TTL: 600, Aliases: "www.google.com"},
+		utils.Service{RecordType: "A", Value: "12.0.0.5", TTL: 600, Aliases: "www.google.com"}); result == nil {
 		t.Errorf("not get nil")
 	}
-	l.Add(utils.Service{"AAAA", "2404:6800:4008:c06::63", 600, "www.google.com"})
-	l.Add(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"A", "11.0.0.0", 600, "www.google.com"})
-	l.Remove(utils.Service{"MX", "www.baidu.com", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "11.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "12.0.0.0", 600, "www.google.com"})
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.google.com"})
+	l.Add(utils.Service{RecordType: "AAAA", Value: "2404:6800:4008:c06::63", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "A", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Remove(utils.Service{RecordType: "MX", Value: "www.baidu.com", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "11.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "12.0.0.0", TTL: 600, Aliases: "www.google.com"})
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.google.com"})
 	fmt.Println(l.List())
 	l.Purge()
-	l.Add(utils.Service{"MX", "13.0.0.0", 600, "www.oschina.com"})
-	if result := l.Set(utils.Service{"MX", "13.0.0.0", 600, "www.oschina.com"},
-		utils.Service{"MX", "13.0.0.1", 600, "www.oschina.com"}); result != nil {
+	l.Add(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.oschina.com"})
+	if result := l.Set(utils.Service{RecordType: "MX", Value: "13.0.0.0", TTL: 600, Aliases: "www.oschina.com"},
+		utils.Service{RecordType: "MX", Value: "13.0.0.1", TTL: 600, Aliases: "www.oschina.com"}); result != nil {
 		t.Errorf("should get nil")
 	}
 	fmt.Println(l.List())
-	fmt.Println(l.Get(utils.Service{"MX", "", 600, "www.oschina.com"}))
+	fmt.Println(l.Get(utils.Service{RecordType: "MX", Value: "", TTL: 600, Aliases: "www.oschina.com"}))
 	l.Purge()
 	l.RemoveOldest()
 }
+
+func TestSimpleLRUContainName(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 600, Aliases: "a.b.preview.suphawking.com."})
+
+	if !l.ContainName("a.b.preview.suphawking.com.") || !l.ContainName("b.preview.suphawking.com.") || !l.ContainName("preview.suphawking.com.") {
+		t.Error("The stored name and its ancestors should be found")
+	}
+	if l.ContainName("c.preview.suphawking.com.") || l.ContainName("review.suphawking.com.") {
+		t.Error("Only the stored name and its ancestors should be found")
+	}
+}
+
+func TestSimpleLRUAddTTL(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	if !l.Add(utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 600, Aliases: "web.suphawking.com."}) {
+		t.Error("Expected the record to be stored")
+	}
+	if l.Add(utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 600, Aliases: "web.suphawking.com."}) {
+		t.Error("Expected the identical record to change nothing")
+	}
+	if !l.Add(utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 60, Aliases: "web.suphawking.com."}) {
+		t.Error("Expected the TTL to be updated")
+	}
+	if result, _ := l.Get(utils.Service{RecordType: "A", Aliases: "web.suphawking.com."}); len(result) != 1 || result[0].TTL != 60 {
+		t.Error("Expected one record with a TTL of 60, got", result)
+	}
+}
+
+func TestSimpleLRURemove(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.1", TTL: 600, Aliases: "a.b.preview.suphawking.com."})
+	l.Add(utils.Service{RecordType: "A", Value: "10.0.0.2", TTL: 600, Aliases: "a.b.preview.suphawking.com."})
+
+	l.Remove(utils.Service{RecordType: "A", Value: "10.0.0.1", Aliases: "a.b.preview.suphawking.com."})
+	if result, _ := l.Get(utils.Service{RecordType: "A", Aliases: "a.b.preview.suphawking.com."}); len(result) != 1 || result[0].Value != "10.0.0.2" {
+		t.Error("Expected: 10.0.0.2 Got:", result)
+	}
+	l.Remove(utils.Service{RecordType: "A", Value: "10.0.0.2", Aliases: "a.b.preview.suphawking.com."})
+	if l.Containkey("a.b.preview.suphawking.com.") || l.ContainName("preview.suphawking.com.") {
+		t.Error("Name without records should be removed")
+	}
+}
+
+func TestSimpleLRUReverse(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	l.Add(utils.Service{RecordType: "A", Value: "10.1.2.3", TTL: 600, Aliases: "web1.suphawking.com."})
+	l.Add(utils.Service{RecordType: "A", Value: "10.1.2.3", TTL: 600, Aliases: "web2.suphawking.com."})
+	l.Add(utils.Service{RecordType: "CNAME", Value: "web1.suphawking.com.", TTL: 600, Aliases: "www.suphawking.com."})
+
+	if result := l.GetReverse("3.2.1.10.in-addr.arpa."); len(result) != 2 {
+		t.Error("Expected two records Got:", result)
+	}
+	if !l.ContainReverse("1.10.in-addr.arpa.") || l.ContainReverse("2.10.in-addr.arpa.") {
+		t.Error("Only the reverse names of 10.1.2.3 should be found")
+	}
+
+	l.Set(utils.Service{RecordType: "A", Value: "10.1.2.3", Aliases: "web2.suphawking.com."}, utils.Service{RecordType: "A", Value: "10.2.0.1", TTL: 600, Aliases: "web2.suphawking.com."})
+	if result := l.GetReverse("3.2.1.10.in-addr.arpa."); len(result) != 1 || result[0].Aliases != "web1.suphawking.com." {
+		t.Error("Expected web1.suphawking.com. Got:", result)
+	}
+	l.Remove(utils.Service{RecordType: "A", Value: "10.1.2.3", Aliases: "web1.suphawking.com."})
+	if l.ContainReverse("1.10.in-addr.arpa.") || !l.ContainReverse("2.10.in-addr.arpa.") {
+		t.Error("Only the reverse names of 10.2.0.1 should be left")
+	}
+}
@@ -4,164 +4,295 @@ import (
 	"container/list"
 	"errors"
 	"github.com/miekg/dns"
+	"strings"
 	"time"
 )
 
-type EvictCallback func(s *[]dns.RR)
+// Key identifies a cached response by the question and the DNSSEC bits of
+// the query it answers.
+type Key struct {
+	Name   string
+	Qtype  uint16
+	Qclass uint16
+	DO     bool
+	CD     bool
+}
+
+// NewKey returns the key of the response to r, names are case insensitive.
+func NewKey(r *dns.Msg) Key {
+	q := r.Question[0]
+	opt := r.IsEdns0()
+	return Key{
+		Name:   strings.ToLower(q.Name),
+		Qtype:  q.Qtype,
+		Qclass: q.Qclass,
+		DO:     opt != nil && opt.Do(),
+		CD:     r.CheckingDisabled,
+	}
+}
+
+// Entry is a cached response with the time it was added and the number of
+// lookups since. Size is the uncompressed length of the response in wire
+// format, TTL the lowest TTL of its records. Prefetched tells whether a refresh of the response
+// before it expires was started.
+type Entry struct {
+	Key        Key
+	Msg        *dns.Msg
+	Time       time.Time
+	Hits       uint64
+	Size       int
+	TTL        uint32
+	Prefetched bool
 
-type Record struct {
-	list *list.Element
-	Time time.Time
+	sweepElem *list.Element
 }
 
-type Records struct {
-	table map[interface{}]*Record
+// Expired tells whether the response expired longer than window before
+// now, records expire when less than a second remains.
+func (e *Entry) Expired(now time.Time, window time.Duration) bool {
+	expiration := e.Time.Add(time.Duration(e.TTL)*time.Second - time.Second + window)
+	return !expiration.After(now)
+}
+
+// MinTTL returns the lowest TTL of the records of m, OPT records aside.
+func MinTTL(m *dns.Msg) uint32 {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl
 }
 
+type EvictCallback func(e *Entry)
+
+// LRU is a bounded store of responses, when it is full it evicts the
+// entries its policy picks, the least recently used ones by default.
 type LRU struct {
 	size      int
-	evictList *list.List
-	items     map[interface{}]*Records
+	maxBytes  int
+	bytes     int
+	evictions uint64
+	policy    Policy
+	items     map[Key]*Entry
 	onEvict   EvictCallback
+
+	// sweep holds the keys in the order they were added, sweepNext is the
+	// one the next RemoveExpired call starts from.
+	sweep     *list.List
+	sweepNext *list.Element
 }
 
 func NewLRU(size int, onEvict EvictCallback) (*LRU, error) {
+	return NewBoundedLRU(size, 0, onEvict)
+}
+
+// NewBoundedLRU constructs a LRU of size entries whose responses take at
+// most maxBytes in wire format, 0 only bounds the number of entries.
+func NewBoundedLRU(size int, maxBytes int, onEvict EvictCallback) (*LRU, error) {
+	return NewPolicyLRU(size, maxBytes, newLRUPolicy(), onEvict)
+}
+
+// NewPolicyLRU constructs a bounded LRU evicting the entries policy picks.
+func NewPolicyLRU(size int, maxBytes int, policy Policy, onEvict EvictCallback) (*LRU, error) {
 	if size <= 0 {
 		return nil, errors.New("Must provide a positive size")
 	}
+	if maxBytes < 0 {
+		return nil, errors.New("Must provide a positive number of bytes")
+	}
 	c := &LRU{
-		size:      size,
-		evictList: list.New(),
-		items:     make(map[interface{}]*Records),
-		onEvict:   onEvict,
+		size:     size,
+		maxBytes: maxBytes,
+		policy:   policy,
+		items:    make(map[Key]*Entry),
+		onEvict:  onEvict,
+		sweep:    list.New(),
 	}
 	return c, nil
 }
 
 // Purge is used to completely clear the cache
 func (c *LRU) Purge() {
-	for e := c.evictList.Front(); e != nil; e = e.Next() {
-		if c.onEvict != nil {
-			c.onEvict(e.Value.(*[]dns.RR))
+	if c.onEvict != nil {
+		for _, entry := range c.items {
+			c.onEvict(entry)
 		}
 	}
-	c.items = make(map[interface{}]*Records)
-	c.evictList.Init()
+	c.items = make(map[Key]*Entry)
+	c.policy.Purge()
+	c.sweep.Init()
+	c.sweepNext = nil
+	c.bytes = 0
+}
+
+// Add adds the response m under key, replacing the previous one.  Returns
+// true if an eviction occurred. A response larger than maxBytes is not
+// cached, and the previous one is removed.
+func (c *LRU) Add(key Key, m *dns.Msg) bool {
+	return c.AddAt(key, m, time.Now())
 }
 
-// Add adds a value to the cache.  Returns true if an eviction occurred.
-func (c *LRU) Add(s []dns.RR, rrtype uint16) bool {
-	if len(s) == 0 {
+// AddAt adds the response m under key as if it was added at t, e.g. when
+// it is restored from a snapshot.  Returns true if an eviction occurred.
+func (c *LRU) AddAt(key Key, m *dns.Msg, t time.Time) bool {
+	entry := &Entry{Key: key, Msg: m, Time: t, Size: m.Len(), TTL: MinTTL(m)}
+	if c.maxBytes > 0 && entry.Size > c.maxBytes {
+		c.Remove(key)
 		return false
 	}
-	name := s[0].Header().Name
-	if elements := c.items[name]; elements != nil {
-		if element := elements.table[rrtype]; element == nil {
-			if len(elements.table) == 0 {
-				Records := &Record{}
-				elements.table[rrtype] = Records
-			} else {
-				for rt := range elements.table {
-					if (rt == dns.TypeA || rt == dns.TypeAAAA) && (rrtype == dns.TypeCNAME) {
-						return false
-					}
-					if (rrtype == dns.TypeA || rrtype == dns.TypeAAAA) && (rt == dns.TypeCNAME) {
-						return false
-					} else {
-						Records := &Record{}
-						elements.table[rrtype] = Records
-					}
-				}
-			}
-		}
-		elements.table[rrtype].list = c.evictList.PushFront(&s)
-		elements.table[rrtype].Time = time.Now()
+	if old, ok := c.items[key]; ok {
+		c.bytes -= old.Size
+		c.policy.Touch(key)
+		entry.sweepElem = old.sweepElem
 	} else {
-		c.addNew(s)
+		c.policy.Add(key)
+		entry.sweepElem = c.sweep.PushBack(key)
 	}
-	evict := c.evictList.Len() > c.size
-	if evict {
+	c.items[key] = entry
+	c.bytes += entry.Size
+	evict := false
+	for len(c.items) > c.size || c.maxBytes > 0 && c.bytes > c.maxBytes {
 		c.RemoveOldest()
+		c.evictions++
+		evict = true
 	}
 	return evict
 }
 
-func (c *LRU) addNew(s []dns.RR) {
-	rrtype := s[0].Header().Rrtype
-	name := s[0].Header().Name
-	entries := &s
-	newRecord := &Record{}
-	(*newRecord).list = c.evictList.PushFront(entries)
-	(*newRecord).Time = time.Now()
-	newRecords := &Records{table: make(map[interface{}]*Record)}
-	newRecords.table[rrtype] = newRecord
-	c.items[name] = newRecords
+// Get looks up a key's value from the cache, counts the hit and updates the
+// recent-ness of the key.
+func (c *LRU) Get(key Key) (Entry, error) {
+	entry, ok := c.items[key]
+	if !ok {
+		return Entry{}, errors.New("Not exist")
+	}
+	c.policy.Touch(key)
+	entry.Hits++
+	return *entry, nil
 }
 
-// Get looks up a key's value from the cache.
-func (c *LRU) Get(name string, rtype uint16) ([]dns.RR, *time.Time, error) {
-	element := c.items[name]
-	if element == nil {
-		return []dns.RR{}, &time.Time{}, errors.New("Not exist")
+// Peek looks up a key's value without counting a hit or updating the
+// recent-ness of the key.
+func (c *LRU) Peek(key Key) (Entry, error) {
+	entry, ok := c.items[key]
+	if !ok {
+		return Entry{}, errors.New("Not exist")
 	}
-	record := element.table[rtype]
-	if record == nil {
-		return []dns.RR{}, &time.Time{}, errors.New("Not exist")
+	return *entry, nil
+}
+
+// MarkPrefetched flags the response under key as being refreshed before it
+// expires, it returns false if there is no such response or it already was
+// flagged, so that a response is refreshed once.
+func (c *LRU) MarkPrefetched(key Key) bool {
+	entry, ok := c.items[key]
+	if !ok || entry.Prefetched {
+		return false
 	}
-	return *(record.list.Value.(*[]dns.RR)), &record.Time, nil
+	entry.Prefetched = true
+	return true
 }
 
 // Check if a key is in the cache, without updating the recent-ness
 // or deleting it for being stale.
-func (c *LRU) Contains(key interface{}) (ok bool) {
+func (c *LRU) Contains(key Key) (ok bool) {
 	_, ok = c.items[key]
 	return ok
 }
 
-// RemoveOldest removes the oldest item from the cache.
+// RemoveOldest removes the item the policy evicts next from the cache.
 func (c *LRU) RemoveOldest() {
-	delElem := c.evictList.Back()
-	if delElem == nil {
+	key, ok := c.policy.Evict()
+	if !ok {
 		return
 	}
-	del := delElem.Value.(*[]dns.RR)
-	name := (*del)[0].Header().Name
-	rtype := (*del)[0].Header().Rrtype
-	delValue := c.items[name]
-	delete(delValue.table, rtype)
-	c.evictList.Remove(delElem)
+	c.removeEntry(c.items[key])
+}
+
+// Keys returns a slice of the keys in the cache, from the next evicted to
+// the last.
+func (c *LRU) Keys() []Key {
+	return c.policy.Keys()
 }
 
-// Keys returns a slice of the keys in the cache, from oldest to newest.
-func (c *LRU) Keys() []interface{} {
-	keys := make([]interface{}, c.evictList.Len())
-	i := 0
-	for ent := c.evictList.Back(); ent != nil; ent = ent.Prev() {
-		content := ent.Value.(*[]dns.RR)
-		keys[i] = (*content)[0].Header().Name
-		i++
+// Entries returns the entries in the cache, from the next evicted to the
+// last.
+func (c *LRU) Entries() []Entry {
+	keys := c.policy.Keys()
+	entries := make([]Entry, len(keys))
+	for i, key := range keys {
+		entries[i] = *c.items[key]
 	}
-	return keys
+	return entries
 }
 
 // Len returns the number of items in the cache.
 func (c *LRU) Len() int {
-	return c.evictList.Len()
+	return len(c.items)
 }
 
-func (c *LRU) Remove(name string, rtype uint16) error {
-	element := c.items[name]
-	if element == nil {
-		return errors.New("Not exist")
+// Bytes returns the size of the responses in the cache in wire format.
+func (c *LRU) Bytes() int {
+	return c.bytes
+}
+
+// Evictions returns the number of entries evicted to make room for others.
+func (c *LRU) Evictions() uint64 {
+	return c.evictions
+}
+
+// RemoveExpired looks at up to limit entries and removes the ones expired
+// longer than window before now, it returns how many entries and bytes
+// were removed. Each call resumes where the previous one stopped, so
+// repeated calls look at every entry in turn.
+func (c *LRU) RemoveExpired(now time.Time, window time.Duration, limit int) (removed int, bytes int) {
+	if limit > len(c.items) {
+		limit = len(c.items)
 	}
-	record := element.table[rtype]
-	if record == nil {
-		return errors.New("Not exist")
+	for ; limit > 0; limit-- {
+		if c.sweepNext == nil {
+			c.sweepNext = c.sweep.Front()
+		}
+		entry := c.items[c.sweepNext.Value.(Key)]
+		c.sweepNext = c.sweepNext.Next()
+		if entry.Expired(now, window) {
+			c.policy.Remove(entry.Key)
+			c.removeEntry(entry)
+			removed++
+			bytes += entry.Size
+		}
 	}
-	c.evictList.Remove(record.list)
-	delete(element.table, rtype)
-	if len(element.table) == 0 {
-		delete(c.items, name)
+	return removed, bytes
+}
+
+func (c *LRU) Remove(key Key) error {
+	entry, ok := c.items[key]
+	if !ok {
+		return errors.New("Not exist")
 	}
+	c.policy.Remove(key)
+	c.removeEntry(entry)
 	return nil
 }
+
+// removeEntry is used to remove a given entry from the cache
+func (c *LRU) removeEntry(entry *Entry) {
+	if c.sweepNext == entry.sweepElem {
+		c.sweepNext = c.sweepNext.Next()
+	}
+	c.sweep.Remove(entry.sweepElem)
+	delete(c.items, entry.Key)
+	c.bytes -= entry.Size
+	if c.onEvict != nil {
+		c.onEvict(entry)
+	}
+}
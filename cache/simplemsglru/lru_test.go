@@ -3,10 +3,12 @@ package simplemsglru
 import (
 	"fmt"
 	"github.com/miekg/dns"
+	"strings"
 	"testing"
+	"time"
 )
 
-func getmsg(name string, rtype uint16) dns.Msg {
+func getmsg(name string, rtype uint16) *dns.Msg {
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = true
@@ -14,33 +16,164 @@ func getmsg(name string, rtype uint16) dns.Msg {
 	m1.Question[0] = dns.Question{name, rtype, dns.ClassINET}
 	c := new(dns.Client)
 	in, _, _ := c.Exchange(m1, "8.8.8.8:53")
-	return *in
+	return in
+}
+
+func key(name string, rtype uint16) Key {
+	return Key{Name: name, Qtype: rtype, Qclass: dns.ClassINET}
 }
 
 func TestSimleMsgLRU(t *testing.T) {
-	_, err := NewLRU(0, func(s *[]dns.RR) { fmt.Println(*s) })
+	_, err := NewLRU(0, func(e *Entry) { fmt.Println(e.Key) })
 	if err == nil {
 		t.Errorf("should get a error")
 	}
-	l, err := NewLRU(3, func(s *[]dns.RR) { fmt.Println(*s) })
+	l, err := NewLRU(3, func(e *Entry) { fmt.Println(e.Key) })
 	if err != nil {
 		t.Errorf("fail to create LRU")
 	}
-	l.Add(getmsg("www.baidu.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.google.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.google.com.", dns.TypeAAAA).Answer, dns.TypeAAAA)
-	l.Add(getmsg("www.renren.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.taobao.com.", dns.TypeA).Answer, dns.TypeA)
-	l.Add(getmsg("www.weibo.com.", dns.TypeA).Answer, dns.TypeA)
-	fmt.Println(l.Get("www.baidu.com.", dns.TypeA))
-	fmt.Println(l.Get("www.weibo.com.", dns.TypeA))
-	fmt.Println(l.Get("www.weibo.com.", dns.TypeCNAME))
+	l.Add(key("www.baidu.com.", dns.TypeA), getmsg("www.baidu.com.", dns.TypeA))
+	l.Add(key("www.google.com.", dns.TypeA), getmsg("www.google.com.", dns.TypeA))
+	l.Add(key("www.google.com.", dns.TypeAAAA), getmsg("www.google.com.", dns.TypeAAAA))
+	l.Add(key("www.renren.com.", dns.TypeA), getmsg("www.renren.com.", dns.TypeA))
+	l.Add(key("www.taobao.com.", dns.TypeA), getmsg("www.taobao.com.", dns.TypeA))
+	l.Add(key("www.weibo.com.", dns.TypeA), getmsg("www.weibo.com.", dns.TypeA))
+	fmt.Println(l.Get(key("www.baidu.com.", dns.TypeA)))
+	fmt.Println(l.Get(key("www.weibo.com.", dns.TypeA)))
+	fmt.Println(l.Get(key("www.weibo.com.", dns.TypeCNAME)))
 	fmt.Println(l.Len())
 	fmt.Println(l.Keys())
-	l.Contains("www.baidu.com.")
-	l.Remove("www.weibo.com.", dns.TypeA)
-	l.Remove("www.weibo.com.", dns.TypeCNAME)
-	l.Remove("www.wwweeeiiiibo.com.", dns.TypeA)
+	l.Contains(key("www.baidu.com.", dns.TypeA))
+	l.Remove(key("www.weibo.com.", dns.TypeA))
+	l.Remove(key("www.weibo.com.", dns.TypeCNAME))
+	l.Remove(key("www.wwweeeiiiibo.com.", dns.TypeA))
 
 	l.Purge()
 }
+
+func TestSimpleMsgLRUReplace(t *testing.T) {
+	l, _ := NewLRU(1, nil)
+	first, second := new(dns.Msg), new(dns.Msg)
+	first.SetQuestion("www.example.com.", dns.TypeA)
+	second.SetQuestion("www.example.com.", dns.TypeA)
+	rr, _ := dns.NewRR("www.example.com. 300 IN A 192.0.2.1")
+	first.Answer = []dns.RR{rr}
+	rr, _ = dns.NewRR("www.example.com. 300 IN A 192.0.2.2")
+	second.Answer = []dns.RR{rr}
+	l.Add(NewKey(first), first)
+	l.Add(NewKey(second), second)
+	if l.Len() != 1 {
+		t.Error("Expected the record to be replaced, got", l.Len(), "entries")
+	}
+	result, err := l.Get(key("www.example.com.", dns.TypeA))
+	if err != nil || result.Msg != second {
+		t.Error("Expected the new response, got:", result.Msg, err)
+	}
+}
+
+func TestNewKey(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("WWW.Example.COM.", dns.TypeAAAA)
+	if k := NewKey(m); k != key("www.example.com.", dns.TypeAAAA) {
+		t.Error("Expected a lowercased key without DNSSEC bits, got", k)
+	}
+	m.SetEdns0(1232, true)
+	m.CheckingDisabled = true
+	if k := NewKey(m); !k.DO || !k.CD {
+		t.Error("Expected the DO and CD bits in the key, got", k)
+	}
+}
+
+func TestSimpleMsgLRUCNAMEChain(t *testing.T) {
+	l, _ := NewLRU(2, nil)
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME web.example.net.")
+	a, _ := dns.NewRR("web.example.net. 300 IN A 192.0.2.1")
+	m.Answer = []dns.RR{cname, a}
+	l.Add(NewKey(m), m)
+	if _, err := l.Get(key("www.example.com.", dns.TypeA)); err != nil {
+		t.Error("Expected the chain to be stored under the query name:", err)
+	}
+	if l.Contains(key("web.example.net.", dns.TypeA)) {
+		t.Error("Expected nothing stored under the target")
+	}
+}
+
+func TestSimpleMsgLRUBytes(t *testing.T) {
+	if _, err := NewBoundedLRU(10, -1, nil); err == nil {
+		t.Error("should get a error")
+	}
+	reply := func(name string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeTXT)
+		rr, _ := dns.NewRR(name + ` 300 IN TXT "` + strings.Repeat("x", 200) + `"`)
+		m.Answer = []dns.RR{rr}
+		return m
+	}
+	size := reply("a.example.com.").Len()
+	l, _ := NewBoundedLRU(10, 2*size, nil)
+	l.Add(key("a.example.com.", dns.TypeTXT), reply("a.example.com."))
+	l.Add(key("b.example.com.", dns.TypeTXT), reply("b.example.com."))
+	if l.Len() != 2 || l.Bytes() != 2*size || l.Evictions() != 0 {
+		t.Error("Expected 2 entries of", size, "bytes, got", l.Len(), l.Bytes(), l.Evictions())
+	}
+	l.Add(key("c.example.com.", dns.TypeTXT), reply("c.example.com."))
+	if l.Len() != 2 || l.Bytes() != 2*size || l.Evictions() != 1 || l.Contains(key("a.example.com.", dns.TypeTXT)) {
+		t.Error("Expected the oldest entry to be evicted, got", l.Keys(), l.Bytes(), l.Evictions())
+	}
+	l.Remove(key("b.example.com.", dns.TypeTXT))
+	if l.Bytes() != size {
+		t.Error("Expected", size, "bytes, got", l.Bytes())
+	}
+
+	// a response larger than the whole budget doesn't flush the others
+	big := reply("big.example.com.")
+	big.Answer = append(big.Answer, reply("big.example.com.").Answer[0], reply("big.example.com.").Answer[0])
+	if l.Add(key("big.example.com.", dns.TypeTXT), big) || l.Len() != 1 || l.Bytes() != size || l.Evictions() != 1 {
+		t.Error("Expected the large response not to be cached, got", l.Keys(), l.Bytes(), l.Evictions())
+	}
+}
+
+func TestSimpleMsgLRURemoveExpired(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	for i, ttl := range []int{1, 1, 300} {
+		m := new(dns.Msg)
+		name := fmt.Sprintf("www%d.example.com.", i)
+		m.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A 192.0.2.1", name, ttl))
+		m.Answer = []dns.RR{rr}
+		l.Add(key(name, dns.TypeA), m)
+	}
+	if removed, _ := l.RemoveExpired(time.Now(), time.Hour, 10); removed != 0 {
+		t.Error("Expected the stale entries to be kept, got", removed, "removed")
+	}
+	if removed, _ := l.RemoveExpired(time.Now(), 0, 1); removed > 1 {
+		t.Error("Expected at most 1 entry to be looked at, got", removed, "removed")
+	}
+	l.RemoveExpired(time.Now(), 0, 10)
+	if l.Len() != 1 || len(l.Keys()) != 1 || !l.Contains(key("www2.example.com.", dns.TypeA)) {
+		t.Error("Expected the fresh entry only, got", l.Keys())
+	}
+}
+
+func TestSimpleMsgLRURemoveExpiredResumes(t *testing.T) {
+	l, _ := NewLRU(10, nil)
+	for i := 0; i < 10; i++ {
+		m := new(dns.Msg)
+		name := fmt.Sprintf("www%d.example.com.", i)
+		m.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 1 IN A 192.0.2.1", name))
+		m.Answer = []dns.RR{rr}
+		l.Add(key(name, dns.TypeA), m)
+	}
+	l.Get(key("www0.example.com.", dns.TypeA))
+	for i := 0; i < 4; i++ {
+		if removed, _ := l.RemoveExpired(time.Now(), 0, 3); removed != 3 && l.Len() > 0 {
+			t.Error("Expected 3 entries to be removed, got", removed)
+		}
+	}
+	if l.Len() != 0 || l.sweep.Len() != 0 {
+		t.Error("Expected successive sweeps to remove every entry, got", l.Keys())
+	}
+}
@@ -0,0 +1,314 @@
+package simplemsglru
+
+import (
+	"container/list"
+	"errors"
+)
+
+// Policy picks the entries a full LRU evicts, it only tracks keys.
+type Policy interface {
+	// Add records a key new to the cache
+	Add(key Key)
+	// Touch records a lookup or a replacement of a cached key
+	Touch(key Key)
+	// Remove forgets a key removed from the cache
+	Remove(key Key)
+	// Evict forgets and returns the key to evict next
+	Evict() (Key, bool)
+	// Keys returns the keys from the next evicted to the last
+	Keys() []Key
+	// Purge forgets every key
+	Purge()
+}
+
+// Names of the eviction policies
+const (
+	PolicyLRU      = "lru"
+	PolicyTwoQueue = "2q"
+	PolicyARC      = "arc"
+)
+
+// NewPolicy returns the eviction policy called name for a cache of size
+// entries.
+func NewPolicy(name string, size int) (Policy, error) {
+	switch name {
+	case PolicyLRU, "":
+		return newLRUPolicy(), nil
+	case PolicyTwoQueue:
+		return newTwoQueuePolicy(size), nil
+	case PolicyARC:
+		return newARCPolicy(size), nil
+	}
+	return nil, errors.New("Unknown eviction policy '" + name + "'")
+}
+
+// keyList is a list of keys from the most to the least recently used
+type keyList struct {
+	list  *list.List
+	items map[Key]*list.Element
+}
+
+func newKeyList() *keyList {
+	return &keyList{list: list.New(), items: make(map[Key]*list.Element)}
+}
+
+func (l *keyList) contains(key Key) bool {
+	_, ok := l.items[key]
+	return ok
+}
+
+func (l *keyList) pushFront(key Key) {
+	l.items[key] = l.list.PushFront(key)
+}
+
+func (l *keyList) moveToFront(key Key) {
+	l.list.MoveToFront(l.items[key])
+}
+
+func (l *keyList) remove(key Key) bool {
+	ent, ok := l.items[key]
+	if ok {
+		l.list.Remove(ent)
+		delete(l.items, key)
+	}
+	return ok
+}
+
+func (l *keyList) removeOldest() (Key, bool) {
+	ent := l.list.Back()
+	if ent == nil {
+		return Key{}, false
+	}
+	key := ent.Value.(Key)
+	l.remove(key)
+	return key, true
+}
+
+func (l *keyList) len() int {
+	return l.list.Len()
+}
+
+// keys appends the keys from the least to the most recently used
+func (l *keyList) keys(keys []Key) []Key {
+	for ent := l.list.Back(); ent != nil; ent = ent.Prev() {
+		keys = append(keys, ent.Value.(Key))
+	}
+	return keys
+}
+
+func (l *keyList) purge() {
+	l.list.Init()
+	l.items = make(map[Key]*list.Element)
+}
+
+// lruPolicy evicts the least recently used key
+type lruPolicy struct {
+	keys *keyList
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{keys: newKeyList()}
+}
+
+func (p *lruPolicy) Add(key Key)        { p.keys.pushFront(key) }
+func (p *lruPolicy) Touch(key Key)      { p.keys.moveToFront(key) }
+func (p *lruPolicy) Remove(key Key)     { p.keys.remove(key) }
+func (p *lruPolicy) Evict() (Key, bool) { return p.keys.removeOldest() }
+func (p *lruPolicy) Keys() []Key        { return p.keys.keys(nil) }
+func (p *lruPolicy) Purge()             { p.keys.purge() }
+
+const (
+	// twoQueueRecentRatio is the share of the cache for keys looked up once
+	twoQueueRecentRatio = 0.25
+	// twoQueueGhostRatio is the share of the cache remembered once evicted
+	// from the recent keys
+	twoQueueGhostRatio = 0.5
+)
+
+// twoQueuePolicy is the 2Q policy, keys looked up once wait in a small
+// recent queue and only reach the frequent queue when they are looked up
+// again, so that a scan doesn't flush the frequent keys. Keys evicted from
+// the recent queue are remembered in a ghost queue, to go to the frequent
+// queue when they are added again.
+type twoQueuePolicy struct {
+	recentSize int
+	ghostSize  int
+	recent     *keyList
+	frequent   *keyList
+	ghost      *keyList
+}
+
+func newTwoQueuePolicy(size int) *twoQueuePolicy {
+	return &twoQueuePolicy{
+		recentSize: int(float64(size) * twoQueueRecentRatio),
+		ghostSize:  int(float64(size) * twoQueueGhostRatio),
+		recent:     newKeyList(),
+		frequent:   newKeyList(),
+		ghost:      newKeyList(),
+	}
+}
+
+func (p *twoQueuePolicy) Add(key Key) {
+	if p.ghost.remove(key) {
+		p.frequent.pushFront(key)
+		return
+	}
+	p.recent.pushFront(key)
+}
+
+func (p *twoQueuePolicy) Touch(key Key) {
+	if p.frequent.contains(key) {
+		p.frequent.moveToFront(key)
+	} else if p.recent.remove(key) {
+		p.frequent.pushFront(key)
+	}
+}
+
+func (p *twoQueuePolicy) Remove(key Key) {
+	if !p.recent.remove(key) {
+		p.frequent.remove(key)
+	}
+}
+
+func (p *twoQueuePolicy) Evict() (Key, bool) {
+	if p.recent.len() > 0 && (p.recent.len() > p.recentSize || p.frequent.len() == 0) {
+		key, _ := p.recent.removeOldest()
+		p.ghost.pushFront(key)
+		for p.ghost.len() > p.ghostSize {
+			p.ghost.removeOldest()
+		}
+		return key, true
+	}
+	return p.frequent.removeOldest()
+}
+
+func (p *twoQueuePolicy) Keys() []Key {
+	if p.recent.len() > p.recentSize {
+		return p.frequent.keys(p.recent.keys(nil))
+	}
+	return p.recent.keys(p.frequent.keys(nil))
+}
+
+func (p *twoQueuePolicy) Purge() {
+	p.recent.purge()
+	p.frequent.purge()
+	p.ghost.purge()
+}
+
+// arcPolicy is the Adaptive Replacement Cache policy, it splits the cache
+// between keys looked up once and keys looked up again, and moves the
+// split towards the side whose ghost keys, remembered once evicted, are
+// added again.
+type arcPolicy struct {
+	size int
+	// target is the share of the cache for keys looked up once
+	target   int
+	recent   *keyList
+	frequent *keyList
+	// recentGhost and frequentGhost remember the keys evicted from recent
+	// and frequent
+	recentGhost   *keyList
+	frequentGhost *keyList
+}
+
+func newARCPolicy(size int) *arcPolicy {
+	return &arcPolicy{
+		size:          size,
+		recent:        newKeyList(),
+		frequent:      newKeyList(),
+		recentGhost:   newKeyList(),
+		frequentGhost: newKeyList(),
+	}
+}
+
+func (p *arcPolicy) Add(key Key) {
+	switch {
+	case p.recentGhost.remove(key):
+		// the recent keys were evicted too early
+		delta := 1
+		if p.recentGhost.len() > 0 && p.frequentGhost.len() > p.recentGhost.len() {
+			delta = p.frequentGhost.len() / p.recentGhost.len()
+		}
+		p.target = minInt(p.target+delta, p.size)
+		p.frequent.pushFront(key)
+	case p.frequentGhost.remove(key):
+		// the frequent keys were evicted too early
+		delta := 1
+		if p.frequentGhost.len() > 0 && p.recentGhost.len() > p.frequentGhost.len() {
+			delta = p.recentGhost.len() / p.frequentGhost.len()
+		}
+		p.target = maxInt(p.target-delta, 0)
+		p.frequent.pushFront(key)
+	default:
+		p.recent.pushFront(key)
+	}
+}
+
+func (p *arcPolicy) Touch(key Key) {
+	if p.frequent.contains(key) {
+		p.frequent.moveToFront(key)
+	} else if p.recent.remove(key) {
+		p.frequent.pushFront(key)
+	}
+}
+
+func (p *arcPolicy) Remove(key Key) {
+	if !p.recent.remove(key) {
+		p.frequent.remove(key)
+	}
+}
+
+func (p *arcPolicy) Evict() (Key, bool) {
+	if p.recent.len() > 0 && (p.recent.len() > p.target || p.frequent.len() == 0) {
+		key, _ := p.recent.removeOldest()
+		p.recentGhost.pushFront(key)
+		p.trimGhosts()
+		return key, true
+	}
+	key, ok := p.frequent.removeOldest()
+	if ok {
+		p.frequentGhost.pushFront(key)
+		p.trimGhosts()
+	}
+	return key, ok
+}
+
+// trimGhosts keeps as many recent and recent ghost keys as the cache holds,
+// and twice as many keys overall.
+func (p *arcPolicy) trimGhosts() {
+	for p.recentGhost.len() > 0 && p.recent.len()+p.recentGhost.len() > p.size {
+		p.recentGhost.removeOldest()
+	}
+	for p.frequentGhost.len() > 0 && p.recent.len()+p.frequent.len()+p.recentGhost.len()+p.frequentGhost.len() > 2*p.size {
+		p.frequentGhost.removeOldest()
+	}
+}
+
+func (p *arcPolicy) Keys() []Key {
+	if p.recent.len() > p.target {
+		return p.frequent.keys(p.recent.keys(nil))
+	}
+	return p.recent.keys(p.frequent.keys(nil))
+}
+
+func (p *arcPolicy) Purge() {
+	p.target = 0
+	p.recent.purge()
+	p.frequent.purge()
+	p.recentGhost.purge()
+	p.frequentGhost.purge()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,163 @@
+package simplemsglru
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/miekg/dns"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// queriesFile isn't called trace, go test has a -trace flag of its own
+var queriesFile = flag.String("queries", "", "File of recorded queries, one 'name type' per line, replayed by the policy benchmarks")
+
+func newPolicyLRU(t testing.TB, name string, size int) *LRU {
+	policy, err := NewPolicy(name, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewPolicyLRU(size, 0, policy, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// lookup answers key from l or adds it, like the DNS server does, and
+// tells whether it was a hit.
+func lookup(l *LRU, key Key) bool {
+	if _, err := l.Get(key); err == nil {
+		return true
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(key.Name, key.Qtype)
+	l.Add(key, m)
+	return false
+}
+
+func TestNewPolicy(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyTwoQueue, PolicyARC} {
+		if _, err := NewPolicy(name, 8); err != nil {
+			t.Error(name, err)
+		}
+	}
+	if _, err := NewPolicy("mru", 8); err == nil {
+		t.Error("should get a error")
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	for _, name := range []string{PolicyLRU, PolicyTwoQueue, PolicyARC} {
+		l := newPolicyLRU(t, name, 8)
+		for i := 0; i < 32; i++ {
+			lookup(l, key(fmt.Sprintf("www%d.example.com.", i%12), dns.TypeA))
+			if l.Len() > 8 || len(l.Keys()) != l.Len() {
+				t.Fatal(name, "Expected at most 8 entries, got", l.Len(), l.Keys())
+			}
+		}
+		l.Remove(l.Keys()[0])
+		if l.Len() != 7 || len(l.Keys()) != 7 {
+			t.Error(name, "Expected 7 entries, got", l.Len(), l.Keys())
+		}
+		l.Purge()
+		if l.Len() != 0 || len(l.Keys()) != 0 {
+			t.Error(name, "Expected no entries, got", l.Keys())
+		}
+	}
+}
+
+func TestPolicyScanResistance(t *testing.T) {
+	var tests = map[string]bool{
+		PolicyLRU:      false,
+		PolicyTwoQueue: true,
+		PolicyARC:      true,
+	}
+	for name, resistant := range tests {
+		l := newPolicyLRU(t, name, 16)
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 8; i++ {
+				lookup(l, key(fmt.Sprintf("hot%d.example.com.", i), dns.TypeA))
+			}
+		}
+		for i := 0; i < 64; i++ {
+			lookup(l, key(fmt.Sprintf("scan%d.example.com.", i), dns.TypeA))
+		}
+		kept := 0
+		for i := 0; i < 8; i++ {
+			if l.Contains(key(fmt.Sprintf("hot%d.example.com.", i), dns.TypeA)) {
+				kept++
+			}
+		}
+		if resistant && kept != 8 || !resistant && kept != 0 {
+			t.Error(name, "Unexpected number of hot entries kept after a scan:", kept)
+		}
+	}
+}
+
+// loadTrace returns the queries of the -queries file, or a synthetic trace of
+// popular names following a Zipf distribution interrupted by scans of
+// random names.
+func loadTrace(b *testing.B) []Key {
+	if *queriesFile != "" {
+		f, err := os.Open(*queriesFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer f.Close()
+		var trace []Key
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			qtype := dns.TypeA
+			if len(fields) > 1 {
+				var ok bool
+				if qtype, ok = dns.StringToType[strings.ToUpper(fields[1])]; !ok {
+					b.Fatal("Unknown query type in trace:", scanner.Text())
+				}
+			}
+			trace = append(trace, key(strings.ToLower(dns.Fqdn(fields[0])), qtype))
+		}
+		if err := scanner.Err(); err != nil {
+			b.Fatal(err)
+		}
+		return trace
+	}
+	r := rand.New(rand.NewSource(53))
+	zipf := rand.NewZipf(r, 1.1, 1, 50000)
+	trace := make([]Key, 0, 200000)
+	for len(trace) < cap(trace) {
+		if len(trace)%20000 == 10000 {
+			for i := 0; i < 5000; i++ {
+				trace = append(trace, key(fmt.Sprintf("%x.scan.example.com.", r.Int63()), dns.TypeA))
+			}
+		}
+		trace = append(trace, key(fmt.Sprintf("www%d.example.com.", zipf.Uint64()), dns.TypeA))
+	}
+	return trace
+}
+
+func benchmarkPolicy(b *testing.B, name string) {
+	trace := loadTrace(b)
+	b.ResetTimer()
+	hits, lookups := 0, 0
+	for n := 0; n < b.N; n++ {
+		l := newPolicyLRU(b, name, 2000)
+		for _, k := range trace {
+			if lookup(l, k) {
+				hits++
+			}
+			lookups++
+		}
+	}
+	b.ReportMetric(100*float64(hits)/float64(lookups), "hit%")
+}
+
+func BenchmarkPolicyLRU(b *testing.B)      { benchmarkPolicy(b, PolicyLRU) }
+func BenchmarkPolicyTwoQueue(b *testing.B) { benchmarkPolicy(b, PolicyTwoQueue) }
+func BenchmarkPolicyARC(b *testing.B)      { benchmarkPolicy(b, PolicyARC) }
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/hawkingrei/g53/cache/simplemsglru"
+	"github.com/miekg/dns"
+)
+
+// snapshotVersion is written first in snapshots, to ignore the ones of
+// another format
+const snapshotVersion = 1
+
+// snapshotEntry is a cached response in a snapshot, in wire format
+type snapshotEntry struct {
+	Key  simplemsglru.Key
+	Msg  []byte
+	Time time.Time
+}
+
+// Save writes a snapshot of the cached responses and the time they were
+// added to w, and returns how many were written.
+func (c *MsgCache) Save(w io.Writer) (int, error) {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(snapshotVersion); err != nil {
+		return 0, err
+	}
+	saved := 0
+	for i := range c.lru {
+		c.lock[i].RLock()
+		entries := c.lru[i].Entries()
+		c.lock[i].RUnlock()
+		for _, entry := range entries {
+			buf, err := entry.Msg.Pack()
+			if err != nil {
+				continue
+			}
+			if err := enc.Encode(snapshotEntry{Key: entry.Key, Msg: buf, Time: entry.Time}); err != nil {
+				return saved, err
+			}
+			saved++
+		}
+	}
+	return saved, nil
+}
+
+// Load adds the responses of a snapshot read from r with the time they
+// were added, the expired ones are skipped, even those stale answers could
+// still be served from. It returns how many were added.
+func (c *MsgCache) Load(r io.Reader) (int, error) {
+	dec := gob.NewDecoder(r)
+	var version int
+	if err := dec.Decode(&version); err != nil {
+		return 0, err
+	}
+	if version != snapshotVersion {
+		return 0, errors.New("Unsupported snapshot version")
+	}
+	now := time.Now()
+	loaded := 0
+	for {
+		var saved snapshotEntry
+		if err := dec.Decode(&saved); err == io.EOF {
+			return loaded, nil
+		} else if err != nil {
+			return loaded, err
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(saved.Msg); err != nil {
+			continue
+		}
+		entry := simplemsglru.Entry{Time: saved.Time, TTL: simplemsglru.MinTTL(m)}
+		if entry.Expired(now, 0) {
+			continue
+		}
+		segId := c.segment(saved.Key)
+		c.lock[segId].Lock()
+		c.lru[segId].AddAt(saved.Key, m, saved.Time)
+		c.lock[segId].Unlock()
+		loaded++
+	}
+}
@@ -0,0 +1,54 @@
+package servers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
+)
+
+// cachePolicy returns the bounds of the TTL the answers for name are cached
+// with, a max of 0 leaves the TTL unbounded. Of the cache rules whose domain
+// is name or one of its parents, the one with the longest domain applies,
+// and when its TTL is 0 the answers are not cached at all.
+func (s *DNSServer) cachePolicy(name string) (minTTL uint32, maxTTL uint32, cacheable bool) {
+	minTTL = uint32(s.config.CacheMinTTL / time.Second)
+	maxTTL = uint32(s.config.CacheMaxTTL / time.Second)
+	name = strings.ToLower(name)
+	var match *utils.CacheRule
+	for i, rule := range s.config.CacheRules {
+		if dns.IsSubDomain(rule.Domain, name) && (match == nil || len(rule.Domain) > len(match.Domain)) {
+			match = &s.config.CacheRules[i]
+		}
+	}
+	if match != nil {
+		if match.MaxTTL == 0 {
+			return 0, 0, false
+		}
+		if ruleTTL := uint32(match.MaxTTL / time.Second); maxTTL == 0 || ruleTTL < maxTTL {
+			maxTTL = ruleTTL
+		}
+	}
+	if maxTTL != 0 && minTTL > maxTTL {
+		minTTL = maxTTL
+	}
+	return minTTL, maxTTL, true
+}
+
+// clampTTL bounds the TTL of the records of m, OPT records aside.
+func clampTTL(m *dns.Msg, minTTL uint32, maxTTL uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if rr.Header().Ttl < minTTL {
+				rr.Header().Ttl = minTTL
+			}
+			if maxTTL != 0 && rr.Header().Ttl > maxTTL {
+				rr.Header().Ttl = maxTTL
+			}
+		}
+	}
+}
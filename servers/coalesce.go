@@ -0,0 +1,77 @@
+package servers
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// flightKey identifies upstream queries which can share one answer
+type flightKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	do     bool
+}
+
+func newFlightKey(r *dns.Msg) flightKey {
+	q := r.Question[0]
+	return flightKey{strings.ToLower(q.Name), q.Qtype, q.Qclass, isDO(r)}
+}
+
+// flightCall is an upstream query in flight, its waiters block on wg
+type flightCall struct {
+	wg  sync.WaitGroup
+	msg *dns.Msg
+	err error
+}
+
+// flightGroup coalesces identical upstream queries in flight, the first
+// one is sent and the others wait for its answer.
+type flightGroup struct {
+	lock      sync.Mutex
+	calls     map[flightKey]*flightCall
+	sent      uint64
+	coalesced uint64
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[flightKey]*flightCall)}
+}
+
+// do runs fn unless a call for key is in flight, in which case it waits
+// for that call and reports the answer as shared. The answer must not be
+// modified, it is handed to every waiter.
+func (g *flightGroup) do(key flightKey, fn func() (*dns.Msg, error)) (*dns.Msg, error, bool) {
+	g.lock.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		atomic.AddUint64(&g.coalesced, 1)
+		call.wg.Wait()
+		return call.msg, call.err, true
+	}
+	call := new(flightCall)
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.lock.Unlock()
+	atomic.AddUint64(&g.sent, 1)
+
+	// the waiters are released even if fn panics, the panic goes on to
+	// the caller
+	panicked := true
+	defer func() {
+		if panicked {
+			call.err = errors.New("Upstream query panicked")
+		}
+		g.lock.Lock()
+		delete(g.calls, key)
+		g.lock.Unlock()
+		call.wg.Done()
+	}()
+	call.msg, call.err = fn()
+	panicked = false
+	return call.msg, call.err, false
+}
@@ -0,0 +1,52 @@
+package servers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFlightGroupPanic(t *testing.T) {
+	g := newFlightGroup()
+	key := flightKey{name: "panic.example.com.", qtype: dns.TypeA}
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	go func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected the panic to reach the caller")
+			}
+		}()
+		g.do(key, func() (*dns.Msg, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-started
+
+	waited := make(chan error, 1)
+	go func() {
+		_, err, shared := g.do(key, func() (*dns.Msg, error) { return new(dns.Msg), nil })
+		if !shared {
+			t.Error("Expected the waiter to share the call in flight")
+		}
+		waited <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-waited:
+		if err == nil {
+			t.Error("Expected the waiter to get an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The waiter is still blocked")
+	}
+	if _, err, shared := g.do(key, func() (*dns.Msg, error) { return new(dns.Msg), nil }); err != nil || shared {
+		t.Error("Expected a new call once the panicked one is over, got:", err, shared)
+	}
+}
@@ -1,16 +1,48 @@
 package servers
 
 import (
+	"errors"
+	"fmt"
 	"github.com/miekg/dns"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hawkingrei/g53/cache"
+	"github.com/hawkingrei/g53/cache/simplemsglru"
 	"github.com/hawkingrei/g53/servers/dnsutils"
+	"github.com/hawkingrei/g53/servers/upstream"
 	"github.com/hawkingrei/g53/utils"
 )
 
+// Stats are the counters of the DNS server
+type Stats struct {
+	// Forwarded counts the queries sent upstream
+	Forwarded uint64
+	// Coalesced counts the queries which shared the upstream answer of an
+	// identical query in flight
+	Coalesced uint64
+	// Stale counts the expired answers served when upstreams failed
+	Stale uint64
+	// Prefetched counts the popular answers refreshed before they expired
+	Prefetched uint64
+	// CacheEntries and CacheBytes are the number and the size in wire format
+	// of the answers in the public cache
+	CacheEntries int
+	CacheBytes   int64
+	// CacheEvictions counts the answers evicted to make room for others
+	CacheEvictions uint64
+	// CacheExpired and CacheExpiredBytes count the expired answers and
+	// bytes removed by the sweeps of the cache
+	CacheExpired      uint64
+	CacheExpiredBytes uint64
+}
+
+// maxCnameChain bounds how many private CNAMEs are followed for one query
+const maxCnameChain = 8
+
 // NewService creates a new service
 func NewService() (s *utils.Service) {
 	s = &utils.Service{TTL: -1}
@@ -19,7 +51,7 @@ func NewService() (s *utils.Service) {
 
 // ServiceListProvider represents the entrypoint to get containers
 type ServiceListProvider interface {
-	AddService(utils.Service)
+	AddService(utils.Service) error
 	RemoveService(utils.Service) error
 	//SetService(utils.Service, utils.Service) error
 	GetService(utils.Service) ([]utils.Service, error)
@@ -30,62 +62,169 @@ type ServiceListProvider interface {
 type DNSServer struct {
 	config     *utils.Config
 	server     *dns.Server
+	tcpServer  *dns.Server
+	tlsServer  *dns.Server
 	mux        *dns.ServeMux
 	publicDns  *cache.MsgCache
 	privateDns *cache.Cache
-	dnsclient  *dns.Client
+	zones      *zoneRegistry
+	// reverseZones holds the reverse zones of the configured networks
+	reverseZones *zoneRegistry
+	forwarders   *forwarderRegistry
+	upstreams    *upstream.Pool
+	flights      *flightGroup
+	// nsAddrs are the addresses of the nameserver the NS records point at
+	nsAddrs []net.IP
+	// staleAnswers counts the expired answers served
+	staleAnswers uint64
+	// prefetched counts the answers refreshed before they expired
+	prefetched uint64
+	// stopSave stops the periodic saves of the public cache
+	saveLock sync.Mutex
+	stopSave chan struct{}
 }
 
 // NewDNSServer create a new DNSServer
 func NewDNSServer(c *utils.Config) *DNSServer {
-	publicDns, _ := cache.NewMsgCache(256 * 1)
+	publicDns, err := cache.NewShardedMsgCache(c.CacheSize, c.CacheMemory, c.CacheShards, c.CachePolicy, nil)
+	if err != nil {
+		logger.Fatalf("Unable to create the cache: %s", err)
+	}
 	privateDns, _ := cache.New(10000)
-	dnsclient := new(dns.Client)
-	dnsclient.UDPSize = uint16(4096)
-	dnsclient.Timeout = time.Duration(5) * time.Second
+	dnsclient := upstream.NewClient(c.UpstreamTimeout)
 	s := &DNSServer{
-		config:     c,
-		publicDns:  publicDns,
-		privateDns: privateDns,
-		dnsclient:  dnsclient,
+		config:       c,
+		publicDns:    publicDns,
+		privateDns:   privateDns,
+		zones:        newZoneRegistry(),
+		reverseZones: newZoneRegistry(),
+		forwarders:   newForwarderRegistry(),
+		flights:      newFlightGroup(),
+		upstreams:    upstream.NewPool(dnsclient, upstream.Strategy(c.UpstreamStrategy), c.UpstreamRace),
+	}
+
+	s.loadCache()
+
+	if s.nsAddrs = nsAddresses(c); len(s.nsAddrs) == 0 {
+		logger.Warningf("The NS records of the zones point at a name without address, see --ns-address")
 	}
 
 	logger.Debugf("Handling DNS requests for '%s'.", c.Domain.String())
+	domain := utils.NewZone(c.Domain.String())
+	s.zones.add(domain)
+	for _, network := range c.ReverseCIDRs {
+		for _, name := range dnsutils.ReverseZones(network) {
+			logger.Debugf("Handling reverse DNS requests for '%s'.", name)
+			s.reverseZones.add(utils.Zone{Name: name, Ns: domain.Ns, Mbox: domain.Mbox})
+		}
+	}
+	for _, ns := range c.Nameservers {
+		if _, err := upstream.ParseAddress(ns); err != nil {
+			logger.Errorf("Invalid nameserver: %s", err)
+		}
+	}
+	for _, forwarder := range c.Forwarders {
+		if err := s.AddForwarder(forwarder); err != nil {
+			logger.Errorf("Invalid forwarder for '%s': %s", forwarder.Domain, err)
+		}
+	}
 
 	s.mux = dns.NewServeMux()
 	s.mux.HandleFunc(".", s.handleRequest)
 	s.server = &dns.Server{Addr: c.DnsAddr, Net: "udp", Handler: s.mux}
+	// Connections are kept open for further queries (RFC 7766), queries
+	// pipelined on one connection are answered in order.
+	s.tcpServer = &dns.Server{
+		Addr:          c.DnsAddr,
+		Net:           "tcp",
+		Handler:       s.mux,
+		MaxTCPQueries: -1,
+		IdleTimeout:   func() time.Duration { return c.TcpIdleTimeout },
+	}
+	if c.TlsAddr != "" {
+		s.tlsServer = &dns.Server{
+			Addr:          c.TlsAddr,
+			Net:           "tcp-tls",
+			Handler:       s.mux,
+			MaxTCPQueries: -1,
+			IdleTimeout:   func() time.Duration { return c.TcpIdleTimeout },
+		}
+	}
 
 	return s
 }
 
-// Start starts the DNSServer
+// Start starts the DNSServer on UDP, TCP and optionally TLS, it returns as
+// soon as one of the listeners fails.
 func (s *DNSServer) Start() error {
 	logger.Infof("start DNS Server")
-	return s.server.ListenAndServe()
+	s.upstreams.StartProbing()
+	s.publicDns.StartSweeping(s.config.CacheSweepInterval, s.config.ServeStale)
+	s.startSaving()
+	errs := make(chan error, 3)
+	if s.tlsServer != nil {
+		config, err := newTLSConfig(s.config)
+		if err != nil {
+			return err
+		}
+		s.tlsServer.TLSConfig = config
+		logger.Infof("start DNS over TLS Server on '%s'", s.config.TlsAddr)
+		go func() {
+			errs <- s.tlsServer.ListenAndServe()
+		}()
+	}
+	go func() {
+		errs <- s.tcpServer.ListenAndServe()
+	}()
+	go func() {
+		errs <- s.server.ListenAndServe()
+	}()
+	return <-errs
 }
 
-// Stop stops the DNSServer
+// Stop stops the DNSServer, the public cache is saved into the cache file
 func (s *DNSServer) Stop() {
+	s.upstreams.StopProbing()
+	s.publicDns.StopSweeping()
 	s.server.Shutdown()
+	s.tcpServer.Shutdown()
+	if s.tlsServer != nil {
+		s.tlsServer.Shutdown()
+	}
+	s.stopSaving()
+}
+
+// ServeDNS answers r like the DNS listeners do, e.g. for DNS over HTTPS
+func (s *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	s.mux.ServeDNS(w, r)
 }
 
 //func (s *DNSServer) SetService(originalValue utils.Service, modifyValue utils.Service) error {
 //	return s.privateDns.Set(originalValue, modifyValue)
 //}
 
-// AddService adds a new container and thus new DNS records
-func (s *DNSServer) AddService(service utils.Service) {
-	if service.RecordType == "CNAME" || service.RecordType == "A" {
-		if string(service.Aliases[len(service.Aliases)-1]) != "." {
-			service.Aliases = string(service.Aliases) + "."
+// AddService adds a new container and thus new DNS records, adding a record
+// already stored is not an error.
+func (s *DNSServer) AddService(service utils.Service) error {
+	if _, ok := dns.StringToType[service.RecordType]; ok && service.Aliases != "" {
+		service = normalizeService(service)
+
+		// Other types are kept in presentation format, make sure they parse
+		if _, err := s.makeServiceRR(service.Aliases, service); err != nil {
+			logger.Warningf("Service '%s' ignored: %s", service, err)
+			return err
 		}
 
-		if service.RecordType == "CNAME" && string(service.Value[len(service.Value)-1]) != "." {
-			service.Value = string(service.Value) + "."
+		if service.RecordType == "CNAME" && (s.privateDns.Contains(service.Aliases, "A") || s.privateDns.Contains(service.Aliases, "AAAA")) {
+			logger.Warningf("Service '%s' ignored: conflicting with A or AAAA records", service)
+			return errors.New("CNAME conflicts with the A or AAAA records of the name")
 		}
 
-		s.privateDns.Add(service)
+		if !s.privateDns.Add(service) {
+			logger.Debugf("Service '%s' not added: already stored", service)
+			return nil
+		}
+		s.zones.touch(service.Aliases)
 
 		logger.Debugf("Added service: '%s'.", service)
 		logger.Debugf("Handling DNS requests for '%s'.", service.Aliases)
@@ -97,22 +236,141 @@ func (s *DNSServer) AddService(service utils.Service) {
 
 	} else {
 		logger.Warningf("Service '%s' ignored: No RecordType provided:", service)
+		return errors.New("Property \"RecordType\" is required or wrong")
+	}
+	return nil
+}
+
+// normalizeService spells service the way it is stored: the name lowercase
+// and fully qualified, the host of MX and SRV records in both Target and
+// Value.
+func normalizeService(service utils.Service) utils.Service {
+	if service.Aliases != "" {
+		service.Aliases = dns.Fqdn(strings.ToLower(service.Aliases))
+	}
+	switch service.RecordType {
+	case "MX", "SRV":
+		if service.Target == "" {
+			service.Target = service.Value
+		}
+		if service.Target != "" {
+			service.Target = dns.Fqdn(service.Target)
+		}
+		service.Value = service.Target
+	case "CNAME":
+		if service.Value != "" {
+			service.Value = dns.Fqdn(service.Value)
+		}
 	}
+	return service
 }
 
 // RemoveService removes a new container and thus DNS records
 func (s *DNSServer) RemoveService(service utils.Service) error {
+	service = normalizeService(service)
 	if err := s.privateDns.Remove(service); err != nil {
 		return err
 	}
 	s.mux.HandleRemove(service.Aliases + ".")
+	s.zones.touch(service.Aliases)
 	logger.Debugf("Removeed service '%s'", service)
 
 	return nil
 }
 
+// AddZone adds or replaces a zone g53 is authoritative for
+func (s *DNSServer) AddZone(zone utils.Zone) error {
+	if zone.Name == "" {
+		return errors.New("Property \"Name\" is required")
+	}
+	s.zones.add(zone)
+	logger.Debugf("Added zone '%s'", zone.Name)
+	return nil
+}
+
+// RemoveZone stops g53 from being authoritative for a zone, its records
+// are kept.
+func (s *DNSServer) RemoveZone(name string) error {
+	if err := s.zones.remove(name); err != nil {
+		return err
+	}
+	logger.Debugf("Removed zone '%s'", name)
+	return nil
+}
+
+// GetZone returns the closest zone containing name
+func (s *DNSServer) GetZone(name string) (utils.Zone, bool) {
+	return s.zones.find(name)
+}
+
+// GetAllZones lists the zones g53 is authoritative for
+func (s *DNSServer) GetAllZones() []utils.Zone {
+	return s.zones.list()
+}
+
+// AddForwarder adds or replaces the forwarding rule of a domain
+func (s *DNSServer) AddForwarder(forwarder utils.Forwarder) error {
+	for _, ns := range forwarder.Nameservers {
+		if _, err := upstream.ParseAddress(ns); err != nil {
+			return err
+		}
+	}
+	if err := s.forwarders.add(forwarder); err != nil {
+		return err
+	}
+	logger.Debugf("Added forwarder for '%s'", forwarder.Domain)
+	return nil
+}
+
+// RemoveForwarder removes the forwarding rule of a domain, its names are
+// forwarded to the default nameservers again.
+func (s *DNSServer) RemoveForwarder(domain string) error {
+	if err := s.forwarders.remove(domain); err != nil {
+		return err
+	}
+	logger.Debugf("Removed forwarder for '%s'", domain)
+	return nil
+}
+
+// GetAllForwarders lists the forwarding rules
+func (s *DNSServer) GetAllForwarders() []utils.Forwarder {
+	return s.forwarders.list()
+}
+
+// GetUpstreams lists the health of the nameservers queries are forwarded to
+func (s *DNSServer) GetUpstreams() []upstream.Status {
+	return s.upstreams.Status()
+}
+
+// GetStats returns the counters of the server
+func (s *DNSServer) GetStats() Stats {
+	stats := Stats{
+		Forwarded:  atomic.LoadUint64(&s.flights.sent),
+		Coalesced:  atomic.LoadUint64(&s.flights.coalesced),
+		Stale:      atomic.LoadUint64(&s.staleAnswers),
+		Prefetched: atomic.LoadUint64(&s.prefetched),
+
+		CacheEntries:   s.publicDns.Len(),
+		CacheBytes:     s.publicDns.Bytes(),
+		CacheEvictions: s.publicDns.Evictions(),
+	}
+	stats.CacheExpired, stats.CacheExpiredBytes = s.publicDns.Expired()
+	return stats
+}
+
+// nameserversFor returns the nameservers of the forwarding rule with the
+// longest domain containing name, the default ones without rule.
+func (s *DNSServer) nameserversFor(name string, tr *explainTrace) []string {
+	if forwarder, ok := s.forwarders.find(name); ok {
+		tr.add("forward", "rule for '%s'", forwarder.Domain)
+		return forwarder.Nameservers
+	}
+	return s.config.Nameservers
+}
+
 // GetService reads a service from the repository
 func (s *DNSServer) GetService(service utils.Service) ([]utils.Service, error) {
+	service = normalizeService(service)
 	result, err := s.privateDns.Get(service)
 	if err != nil {
 		return *new([]utils.Service), err
@@ -127,58 +385,141 @@ func (s *DNSServer) GetAllServices() []utils.Service {
 }
 
 func (s *DNSServer) queryDnsCache(r *dns.Msg) (*dns.Msg, error) {
-	return dnsutils.QueryDnsCache(s.publicDns, r)
+	return dnsutils.QueryDnsCache(s.publicDns, r, s.config.ServeStale)
 }
 
-func (s *DNSServer) DNSExchange(nameservers string, r *dns.Msg) (*dns.Msg, []dns.RR, error) {
-	in, _, err := s.dnsclient.Exchange(r, nameservers)
-	if err == nil {
-		if len(in.Answer) != 0 {
-			logger.Debugf(" '%s' '%s' write Cache", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
-			result := in.Answer
-			if len(in.Extra) != 0 {
-				result = append(result, in.Extra...)
-			}
-			s.publicDns.Add(result, r.Question[0].Qtype)
+// exchange sends r to the nameservers, identical queries in flight share
+// one upstream exchange. The answer is a copy carrying the ID and question
+// of r, when every nameserver failed it is their last SERVFAIL or REFUSED
+// reply, if any, returned along with the error.
+func (s *DNSServer) exchange(nameservers []string, r *dns.Msg, tr *explainTrace) (*dns.Msg, error) {
+	in, err, shared := s.flights.do(newFlightKey(r), func() (*dns.Msg, error) {
+		return s.forward(nameservers, r, tr)
+	})
+	if shared {
+		tr.add("upstream", "shared the answer of an identical query in flight")
+	}
+	if in == nil {
+		return nil, err
+	}
+	in = in.Copy()
+	in.Id = r.Id
+	in.Question = append([]dns.Question{}, r.Question...)
+	return in, err
+}
+
+// forward sends r to the nameservers following the upstream strategy,
+// recording every attempt into tr. Answers are cached under the question
+// and DNSSEC bits of r.
+func (s *DNSServer) forward(nameservers []string, r *dns.Msg, tr *explainTrace) (*dns.Msg, error) {
+	in, attempts, err := s.upstreams.Exchange(r, nameservers)
+	for _, attempt := range attempts {
+		if attempt.Err != nil {
+			logger.Errorf("DNS forwarding to %s failed: %s", attempt.Addr, attempt.Err)
+			tr.add("upstream", "%s failed after %s: %s", attempt.Addr, attempt.RTT, attempt.Err)
+		} else if attempt.Addr != "" {
+			tr.add("upstream", "%s answered %s in %s", attempt.Addr, dns.RcodeToString[in.Rcode], attempt.RTT)
 		}
-		return in, in.Answer, err
 	}
-	return new(dns.Msg), []dns.RR{}, err
+	if err != nil {
+		return in, err
+	}
+	s.cacheResponse(r, in)
+	return in, nil
+}
+
+// cacheResponse caches the answer in to r with the TTL bounds of the cache
+// policy. NXDOMAIN and NODATA answers are cached for the TTL of the SOA in
+// their authority section, bounded by its minimum field and MaxNegativeTTL
+// (RFC 2308 section 5).
+func (s *DNSServer) cacheResponse(r *dns.Msg, in *dns.Msg) {
+	if in.Truncated || in.Rcode != dns.RcodeSuccess && in.Rcode != dns.RcodeNameError {
+		return
+	}
+	minTTL, maxTTL, cacheable := s.cachePolicy(r.Question[0].Name)
+	if !cacheable {
+		return
+	}
+	m := in.Copy()
+	m.Extra = removeOPT(m.Extra)
+	clampTTL(m, minTTL, maxTTL)
+	if in.Rcode == dns.RcodeSuccess && len(in.Answer) != 0 {
+		logger.Debugf(" '%s' '%s' write Cache", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
+		s.publicDns.Add(simplemsglru.NewKey(r), m)
+		return
+	}
+	maxNegativeTTL := uint32(s.config.MaxNegativeTTL / time.Second)
+	if maxNegativeTTL == 0 {
+		return
+	}
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		if soa.Minttl < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = soa.Minttl
+		}
+		if maxNegativeTTL < soa.Hdr.Ttl {
+			soa.Hdr.Ttl = maxNegativeTTL
+		}
+		if soa.Hdr.Ttl == 0 {
+			return
+		}
+		logger.Debugf(" '%s' '%s' write negative Cache", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
+		s.publicDns.Add(simplemsglru.NewKey(r), m)
+		return
+	}
 }
 
 func (s *DNSServer) handleForward(w dns.ResponseWriter, r *dns.Msg) {
+	tr := traceOf(w)
 	// Otherwise just forward the request to another server
 	if result, err := s.queryDnsCache(r); err == nil {
 		logger.Debugf("'%s' '%S' Hit Public Cache", r.Question[0].Name, dns.TypeToString[r.Question[0].Qtype])
-		w.WriteMsg(result)
+		ttl, _ := minTTL(result)
+		tr.add("public-cache", "hit, %ds remaining", ttl)
+		if s.config.PrefetchPercent > 0 && dnsutils.NeedsPrefetch(s.publicDns, r, uint64(s.config.PrefetchHits), s.config.PrefetchPercent) && s.publicDns.MarkPrefetched(simplemsglru.NewKey(r)) {
+			tr.add("public-cache", "refreshing the popular answer before it expires")
+			s.prefetch(r)
+		}
+		s.writeMsg(w, r, result)
 		return
+	} else {
+		tr.add("public-cache", "miss")
 	}
+	req := upstreamMsg(r)
+	nameservers := s.nameserversFor(r.Question[0].Name, tr)
 	logger.Debugf("Using DNS forwarding for '%s'", r.Question[0].Name)
-	logger.Debugf("Forwarding DNS nameservers: %s", s.config.Nameservers.String())
-	// look at each Nameserver, stop on success
-	for i := range s.config.Nameservers {
-		//logger.Debugf("Using Nameserver %s", s.config.Nameservers[i])
-
-		in, _, err := s.DNSExchange(s.config.Nameservers[i], r)
-		if err == nil {
-			w.WriteMsg(in)
-			return
-		}
-
-		if i == (len(s.config.Nameservers) - 1) {
-			logger.Noticef("DNS fowarding for '%s' failed: no more nameservers to try", err.Error())
+	logger.Debugf("Forwarding DNS nameservers: %s", strings.Join(nameservers, " "))
+	in, err := s.exchangeOrStale(nameservers, r, req, tr)
+	if err == nil {
+		s.writeMsg(w, r, in)
+		return
+	}
+	logger.Noticef("DNS fowarding for '%s' failed: %s", r.Question[0].Name, err.Error())
 
-			// Send failure reply
-			m := new(dns.Msg)
-			m.SetReply(r)
-			m.Ns = s.createSOA()
-			m.SetRcode(r, dns.RcodeRefused) // REFUSED
-			w.WriteMsg(m)
+	// Send failure reply
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Ns = s.createSOA(r.Question[0].Name)
+	m.SetRcode(r, dns.RcodeRefused) // REFUSED
+	s.writeMsg(w, r, m)
+}
 
-		} else {
-			logger.Errorf("DNS fowarding for '%s' failed: trying next Nameserver...", err.Error())
+// prefetch refreshes the cached answer to r in background, queries in
+// flight for the same answer are coalesced. Callers mark the cached answer
+// first, so that a failing refresh isn't retried on every hit.
+func (s *DNSServer) prefetch(r *dns.Msg) {
+	req := upstreamMsg(r)
+	nameservers := s.nameserversFor(r.Question[0].Name, nil)
+	go func() {
+		if _, err := s.exchange(nameservers, req, nil); err != nil {
+			logger.Noticef("Unable to prefetch '%s': %s", r.Question[0].Name, err)
+			return
 		}
-	}
+		atomic.AddUint64(&s.prefetched, 1)
+	}()
 }
 
 func (s *DNSServer) makeServiceCNAME(n string, service utils.Service) dns.RR {
@@ -187,7 +528,7 @@ func (s *DNSServer) makeServiceCNAME(n string, service utils.Service) dns.RR {
 	if service.TTL != -1 {
 		ttl = service.TTL
 	} else {
-		ttl = s.config.Ttl
+		ttl = s.defaultTTL(n)
 	}
 
 	rr.Hdr = dns.RR_Header{
@@ -206,7 +547,7 @@ func (s *DNSServer) makeServiceA(n string, service utils.Service) dns.RR {
 	if service.TTL != -1 {
 		ttl = service.TTL
 	} else {
-		ttl = s.config.Ttl
+		ttl = s.defaultTTL(n)
 	}
 
 	rr.Hdr = dns.RR_Header{
@@ -219,26 +560,137 @@ func (s *DNSServer) makeServiceA(n string, service utils.Service) dns.RR {
 	return rr
 }
 
+func (s *DNSServer) makeServiceAAAA(n string, service utils.Service) dns.RR {
+	rr := new(dns.AAAA)
+	var ttl int
+	if service.TTL != -1 {
+		ttl = service.TTL
+	} else {
+		ttl = s.defaultTTL(n)
+	}
+
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypeAAAA,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+	rr.AAAA = net.ParseIP(service.Value)
+	return rr
+}
+
+func (s *DNSServer) makeServiceMX(n string, service utils.Service) dns.RR {
+	rr := new(dns.MX)
+	var ttl int
+	if service.TTL != -1 {
+		ttl = service.TTL
+	} else {
+		ttl = s.defaultTTL(n)
+	}
+
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypeMX,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+	rr.Preference = uint16(service.Preference)
+	rr.Mx = service.Target
+	return rr
+}
+
+func (s *DNSServer) makeServiceSRV(n string, service utils.Service) dns.RR {
+	rr := new(dns.SRV)
+	var ttl int
+	if service.TTL != -1 {
+		ttl = service.TTL
+	} else {
+		ttl = s.defaultTTL(n)
+	}
+
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypeSRV,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+	rr.Priority = uint16(service.Priority)
+	rr.Weight = uint16(service.Weight)
+	rr.Port = uint16(service.Port)
+	rr.Target = service.Target
+	return rr
+}
+
+// makeServicePTR builds the reverse record of an A or AAAA service
+func (s *DNSServer) makeServicePTR(n string, service utils.Service) dns.RR {
+	rr := new(dns.PTR)
+	var ttl int
+	if service.TTL != -1 {
+		ttl = service.TTL
+	} else {
+		ttl = s.defaultTTL(n)
+	}
+
+	rr.Hdr = dns.RR_Header{
+		Name:   n,
+		Rrtype: dns.TypePTR,
+		Class:  dns.ClassINET,
+		Ttl:    uint32(ttl),
+	}
+	rr.Ptr = service.Aliases
+	return rr
+}
+
+// makeServiceGeneric builds a record of a type without a dedicated
+// builder from its rdata in RFC 1035 presentation format.
+func (s *DNSServer) makeServiceGeneric(n string, service utils.Service) (dns.RR, error) {
+	var ttl int
+	if service.TTL != -1 {
+		ttl = service.TTL
+	} else {
+		ttl = s.defaultTTL(n)
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", n, ttl, service.RecordType, service.Value))
+}
+
+// makeServiceRR builds the record of service with owner name n
+func (s *DNSServer) makeServiceRR(n string, service utils.Service) (dns.RR, error) {
+	switch service.RecordType {
+	case "A":
+		return s.makeServiceA(n, service), nil
+	case "AAAA":
+		return s.makeServiceAAAA(n, service), nil
+	case "MX":
+		return s.makeServiceMX(n, service), nil
+	case "SRV":
+		return s.makeServiceSRV(n, service), nil
+	case "CNAME":
+		return s.makeServiceCNAME(n, service), nil
+	}
+	rr, err := s.makeServiceGeneric(n, service)
+	if err == nil && rr == nil {
+		err = errors.New("empty record")
+	}
+	return rr, err
+}
+
 //func (s *DNSServer) RecursionPrivate(service utils.Service) dns.RR {
 //	result, err := s.privateDns.Get(service)//
 //}
 
 func (s *DNSServer) MakePrivateRR(query string, qtype uint16, m *dns.Msg) {
-	result := s.queryServices(utils.Service{dns.TypeToString[qtype], "", 0, strings.ToLower(query)})
+	s.makePrivateRR(query, strings.ToLower(query), qtype, m)
+}
+
+// makePrivateRR appends the records stored under name to m, using query as
+// their owner so that records of a wildcard are synthesized for the query.
+func (s *DNSServer) makePrivateRR(query string, name string, qtype uint16, m *dns.Msg) {
+	result := s.queryServices(utils.Service{RecordType: dns.TypeToString[qtype], Aliases: name})
 	for services := range result {
 		for i := range services {
-			var rr dns.RR
-			switch qtype {
-			case dns.TypeA:
-				rr = s.makeServiceA(query, utils.EntryToServer(&services[i]))
-			case dns.TypeCNAME:
-				rr = s.makeServiceCNAME(query, utils.EntryToServer(&services[i]))
-			default:
-				// this query type isn't supported, but we do have
-				// a record with this name. Per RFC 4074 sec. 3, we
-				// immediately return an empty NOERROR reply.
-				m.Ns = s.createSOA()
-				m.MsgHdr.Authoritative = true
+			rr, err := s.makeServiceRR(query, utils.EntryToServer(&services[i]))
+			if err != nil {
+				logger.Errorf("Unable to build record for '%s': %s", query, err)
 				continue
 			}
 			m.Answer = append(m.Answer, rr)
@@ -247,26 +699,195 @@ func (s *DNSServer) MakePrivateRR(query string, qtype uint16, m *dns.Msg) {
 	}
 }
 
+// privateLookup returns the name of the private store holding the records
+// of query: the query itself or, following RFC 4592, the wildcard child of
+// its closest encloser. Names which only exist because records are stored
+// below them (empty non-terminals) are never matched by a wildcard.
+func (s *DNSServer) privateLookup(query string) (string, bool) {
+	name := strings.ToLower(dns.Fqdn(query))
+	if s.privateDns.Containkey(name) {
+		return name, true
+	}
+	if s.privateDns.ContainName(name) {
+		return "", false
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		encloser := name[off:]
+		if wildcard := "*." + encloser; s.privateDns.Containkey(wildcard) {
+			return wildcard, true
+		}
+		if s.privateDns.ContainName(encloser) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+// resolvePrivate appends the private records of type qtype for name to m.
+// When the name only has a CNAME, the chain is followed through the private
+// store, and the first target the store doesn't know is resolved upstream
+// unless it belongs to our own zone, where it doesn't exist and the answer
+// becomes NXDOMAIN (RFC 6604). The hops are recorded into tr.
+func (s *DNSServer) resolvePrivate(name string, qtype uint16, m *dns.Msg, tr *explainTrace) {
+	key, _ := s.privateLookup(name)
+	for i := 0; i < maxCnameChain; i++ {
+		n := len(m.Answer)
+		s.makePrivateRR(name, key, qtype, m)
+		if len(m.Answer) != n || qtype == dns.TypeCNAME {
+			return
+		}
+		s.makePrivateRR(name, key, dns.TypeCNAME, m)
+		if len(m.Answer) == n {
+			return
+		}
+		name = m.Answer[len(m.Answer)-1].(*dns.CNAME).Target
+		var ok bool
+		if key, ok = s.privateLookup(name); !ok {
+			if !s.isInZone(name) {
+				tr.add("cname", "'%s' is not private, resolving it upstream", name)
+				s.resolveUpstream(name, qtype, m, tr)
+			} else if !s.isZoneApex(name) && !s.privateDns.ContainName(strings.ToLower(name)) {
+				tr.add("cname", "'%s' doesn't exist in our zone", name)
+				m.Rcode = dns.RcodeNameError
+				m.Ns = s.createSOA(name)
+			} else {
+				tr.add("cname", "'%s' has no record in our zone", name)
+			}
+			return
+		}
+		logger.Debugf("Following private CNAME to '%s'", name)
+		tr.add("cname", "following private CNAME to '%s'", name)
+	}
+	logger.Warningf("CNAME chain for '%s' is longer than %d records", name, maxCnameChain)
+}
+
+// handleReverse answers a reverse query with PTR records pointing at every
+// private A or AAAA record holding the address. Names at or below the
+// reverse zones of the configured networks are answered authoritatively,
+// other misses are left to the caller. It reports whether a reply was
+// written.
+func (s *DNSServer) handleReverse(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) bool {
+	tr := traceOf(w)
+	name := strings.ToLower(m.Question[0].Name)
+	if s.privateDns.Containkey(name) {
+		return false
+	}
+	zone, inZone := s.reverseZones.find(name)
+	entries := s.privateDns.GetReverse(name)
+	if len(entries) == 0 && !inZone {
+		return false
+	}
+
+	m.MsgHdr.Authoritative = true
+	qtype := r.Question[0].Qtype
+	switch {
+	case len(entries) > 0 && qtype == dns.TypePTR:
+		tr.add("reverse", "%d private records hold the address of '%s'", len(entries), name)
+		for i := range entries {
+			m.Answer = append(m.Answer, s.makeServicePTR(m.Question[0].Name, utils.EntryToServer(&entries[i])))
+		}
+	case name == zone.Name && qtype == dns.TypeSOA:
+		tr.add("authoritative", "SOA of reverse zone '%s'", zone.Name)
+		m.Answer = s.createSOA(name)
+	case name == zone.Name && qtype == dns.TypeNS:
+		tr.add("authoritative", "NS of reverse zone '%s'", zone.Name)
+		m.Answer = s.createNS(name)
+	case name == zone.Name || s.privateDns.ContainReverse(name):
+		tr.add("reverse", "'%s' has no %s record", name, dns.TypeToString[qtype])
+		m.Ns = s.createSOA(name)
+	default:
+		logger.Debugf("No private record for reverse query '%s'", name)
+		tr.add("reverse", "no private record holds the address of '%s'", name)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = s.createSOA(name)
+	}
+	s.writeMsg(w, r, m)
+	return true
+}
+
+// addPrivateGlue adds the private A and AAAA records of MX, SRV and NS targets
+// to the additional section of m.
+func (s *DNSServer) addPrivateGlue(m *dns.Msg) {
+	for _, rr := range m.Answer {
+		var target string
+		switch v := rr.(type) {
+		case *dns.MX:
+			target = v.Mx
+		case *dns.SRV:
+			target = v.Target
+		case *dns.NS:
+			target = v.Ns
+		default:
+			continue
+		}
+		key, ok := s.privateLookup(target)
+		if !ok {
+			m.Extra = append(m.Extra, s.createNsHost(target, dns.TypeA)...)
+			m.Extra = append(m.Extra, s.createNsHost(target, dns.TypeAAAA)...)
+			continue
+		}
+		glue := new(dns.Msg)
+		s.makePrivateRR(target, key, dns.TypeA, glue)
+		s.makePrivateRR(target, key, dns.TypeAAAA, glue)
+		m.Extra = append(m.Extra, glue.Answer...)
+	}
+}
+
+// resolveUpstream appends the upstream answer for name/qtype to m, which is
+// no longer authoritative then.
+func (s *DNSServer) resolveUpstream(name string, qtype uint16, m *dns.Msg, tr *explainTrace) {
+	askmsg := new(dns.Msg)
+	askmsg.SetQuestion(name, qtype)
+	askmsg.SetEdns0(ednsBufferSize, false)
+	if in, err := s.exchange(s.nameserversFor(name, tr), askmsg, tr); err == nil {
+		m.Answer = append(m.Answer, in.Answer...)
+		m.MsgHdr.Authoritative = false
+		return
+	}
+	logger.Noticef("Unable to resolve CNAME target '%s' upstream", name)
+}
+
+// writeMsg sends m to the client with our OPT record, UDP replies larger
+// than the buffer size advertised by the client are truncated and get the
+// TC bit, replies over TLS are padded.
+func (s *DNSServer) writeMsg(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	setEdns(r, m)
+	if isEncrypted(w) {
+		padMsg(r, m)
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
 //handle with dns request
 func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
+	tr := traceOf(w)
 	m := new(dns.Msg)
 	m.Compress = true
 	m.SetReply(r)
 	m.RecursionAvailable = true
 
-	// Send empty response for empty requests
-	if len(r.Question) == 0 {
-		m.Ns = s.createSOA()
-		w.WriteMsg(m)
+	// Only EDNS version 0 is known (RFC 6891 section 6.1.3)
+	if opt := r.IsEdns0(); opt != nil && opt.Version() != 0 {
+		m.SetRcode(r, dns.RcodeBadVers)
+		tr.add("edns", "unsupported EDNS version %d", opt.Version())
+		s.writeMsg(w, r, m)
 		return
 	}
 
-	// respond to SOA requests
-	if r.Question[0].Qtype == dns.TypeSOA {
-		m.Answer = s.createSOA()
-		w.WriteMsg(m)
+	// Send empty response for empty requests
+	if len(r.Question) == 0 {
+		m.Ns = s.createSOA(s.config.Domain.String())
+		s.writeMsg(w, r, m)
 		return
 	}
+
 	m.Answer = make([]dns.RR, 0, 2)
 	query := r.Question[0].Name
 
@@ -274,50 +895,100 @@ func (s *DNSServer) handleRequest(w dns.ResponseWriter, r *dns.Msg) {
 	if query[len(query)-1] != '.' {
 		query = query + "."
 	}
-	existDomain := s.privateDns.Containkey(query)
+
+	// respond to SOA and NS requests
+	if r.Question[0].Qtype == dns.TypeSOA && s.isZoneApex(query) {
+		m.Answer = s.createSOA(query)
+		m.MsgHdr.Authoritative = true
+		tr.add("authoritative", "SOA of zone '%s'", query)
+		s.writeMsg(w, r, m)
+		return
+	}
+	if r.Question[0].Qtype == dns.TypeNS && s.isZoneApex(query) {
+		m.Answer = s.createNS(query)
+		s.addPrivateGlue(m)
+		m.MsgHdr.Authoritative = true
+		tr.add("authoritative", "NS of zone '%s'", query)
+		s.writeMsg(w, r, m)
+		return
+	}
+	if s.handleReverse(w, r, m) {
+		return
+	}
+
+	key, existDomain := s.privateLookup(query)
 	if existDomain {
 		logger.Debugf("DNS record found for query '%s'  '%s'", query, dns.TypeToString[r.Question[0].Qtype])
-		s.MakePrivateRR(query, r.Question[0].Qtype, m)
-		if len(m.Answer) != 0 && m.Answer[0].Header().Rrtype == dns.TypeSOA {
-			w.WriteMsg(m)
+		tr.add("private", "found under '%s'", key)
+		m.MsgHdr.Authoritative = s.isInZone(query)
+		s.resolvePrivate(query, r.Question[0].Qtype, m, tr)
+		s.addPrivateGlue(m)
+		if len(m.Answer) == 0 && m.MsgHdr.Authoritative {
+			// The name exists but has no record of the requested type,
+			// so answer NODATA rather than asking upstream about it.
+			m.Ns = s.createSOA(m.Question[0].Name)
+		}
+		s.writeMsg(w, r, m)
+		return
+	}
+
+	// Names of our own zone are never forwarded
+	if zone, ok := s.zones.find(query); ok {
+		m.MsgHdr.Authoritative = true
+		if m.Answer = s.createNsHost(query, r.Question[0].Qtype); len(m.Answer) > 0 {
+			tr.add("authoritative", "address of the nameserver of zone '%s'", zone.Name)
+			s.writeMsg(w, r, m)
 			return
 		}
-		if len(m.Answer) == 0 && (r.Question[0].Qtype == dns.TypeA || r.Question[0].Qtype == dns.TypeAAAA) {
-			logger.Debugf("DNS record found for query '%s'  '%s'", query, "CNAME")
-			s.MakePrivateRR(query, dns.TypeA, m)
-		}
-
-		if len(m.Answer) != 0 && m.Answer[len(m.Answer)-1].Header().Rrtype == dns.TypeCNAME {
-			tmplong := len(m.Answer)
-			s.MakePrivateRR(m.Answer[len(m.Answer)-1].String(), dns.TypeCNAME, m)
-			if len(m.Answer) == tmplong {
-				askmsg := new(dns.Msg)
-				askmsg.Id = dns.Id()
-				askmsg.RecursionDesired = true
-				askmsg.Question = make([]dns.Question, 1)
-				askmsg.Question[0] = dns.Question{m.Answer[len(m.Answer)-1].String(), dns.TypeCNAME, dns.ClassINET}
-				for i := range s.config.Nameservers {
-					in, _, err := s.DNSExchange(s.config.Nameservers[i], r)
-					if err == nil {
-						for v := range in.Answer {
-							m.Answer = append(m.Answer, in.Answer[v])
-						}
-						w.WriteMsg(m)
-						return
-					}
-				}
-			}
+		m.Ns = s.createSOA(m.Question[0].Name)
+		if !s.isZoneApex(query) && !s.isNsHost(query) && !s.privateDns.ContainName(strings.ToLower(query)) {
+			logger.Debugf("No DNS record for '%s' in zone", query)
+			m.SetRcode(r, dns.RcodeNameError)
+			tr.add("authoritative", "'%s' doesn't exist in zone '%s'", query, zone.Name)
+		} else {
+			tr.add("authoritative", "'%s' has no record in zone '%s'", query, zone.Name)
 		}
+		s.writeMsg(w, r, m)
+		return
 	}
+
 	// We didn't find a record corresponding to the query
 	if !(len(m.Answer) > 0) {
 		s.handleForward(w, r)
 		return
 	}
-	w.WriteMsg(m)
+	s.writeMsg(w, r, m)
 	return
 }
 
+// isInZone tells whether name belongs to one of our zones
+func (s *DNSServer) isInZone(name string) bool {
+	_, ok := s.zones.find(name)
+	return ok
+}
+
+// isZoneApex tells whether name is one of our zones itself
+func (s *DNSServer) isZoneApex(name string) bool {
+	zone, ok := s.zones.find(name)
+	return ok && zone.Name == strings.ToLower(dns.Fqdn(name))
+}
+
+// defaultTTL returns the TTL of records without their own TTL
+func (s *DNSServer) defaultTTL(name string) int {
+	if zone, ok := s.zones.find(name); ok && zone.Ttl > 0 {
+		return zone.Ttl
+	}
+	return s.config.Ttl
+}
+
+// zoneFor returns the zone or the reverse zone containing name
+func (s *DNSServer) zoneFor(name string) (utils.Zone, bool) {
+	if zone, ok := s.zones.find(name); ok {
+		return zone, true
+	}
+	return s.reverseZones.find(name)
+}
+
 func (s *DNSServer) queryServices(service utils.Service) chan []utils.Entry {
 	c := make(chan []utils.Entry, 10)
 	go func() {
@@ -333,24 +1004,93 @@ func (s *DNSServer) queryServices(service utils.Service) chan []utils.Entry {
 	return c
 }
 
-// TTL is used from config so that not-found result responses are not cached
-// for a long time. The other defaults left as is(skydns source) because they
-// do not have an use case in this situation.
-func (s *DNSServer) createSOA() []dns.RR {
-	dom := dns.Fqdn(s.config.Domain.String() + ".")
+// createSOA returns the SOA record of the zone containing name, or nothing
+// outside of every zone. TTL is used from config, unless the zone has its
+// own, so that not-found result responses are not cached for a long time.
+func (s *DNSServer) createSOA(name string) []dns.RR {
+	zone, ok := s.zoneFor(name)
+	if !ok {
+		return nil
+	}
+	minttl := zone.Minttl
+	if minttl == 0 {
+		minttl = uint32(s.config.Ttl)
+	}
 	soa := &dns.SOA{
 		Hdr: dns.RR_Header{
-			Name:   dom,
+			Name:   zone.Name,
 			Rrtype: dns.TypeSOA,
 			Class:  dns.ClassINET,
-			Ttl:    uint32(s.config.Ttl)},
-		Ns:      "g53." + dom,
-		Mbox:    "g53.g53." + dom,
-		Serial:  uint32(time.Now().Truncate(time.Hour).Unix()),
-		Refresh: 28800,
-		Retry:   7200,
-		Expire:  604800,
-		Minttl:  uint32(s.config.Ttl),
+			Ttl:    minttl},
+		Ns:      zone.Ns,
+		Mbox:    zone.Mbox,
+		Serial:  zone.Serial,
+		Refresh: zone.Refresh,
+		Retry:   zone.Retry,
+		Expire:  zone.Expire,
+		Minttl:  minttl,
 	}
 	return []dns.RR{soa}
 }
+
+// createNS returns the NS record of the zone containing name, pointing at
+// g53 itself, or nothing outside of every zone.
+func (s *DNSServer) createNS(name string) []dns.RR {
+	zone, ok := s.zoneFor(name)
+	if !ok {
+		return nil
+	}
+	ns := &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone.Name,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(s.defaultTTL(zone.Name))},
+		Ns: zone.Ns,
+	}
+	return []dns.RR{ns}
+}
+
+// nsAddresses returns the addresses of the nameserver of the zones, those
+// of the DNS listener unless it listens on every address.
+func nsAddresses(c *utils.Config) []net.IP {
+	if len(c.NsAddresses) > 0 {
+		return c.NsAddresses
+	}
+	host, _, err := net.SplitHostPort(c.DnsAddr)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		return []net.IP{ip}
+	}
+	return nil
+}
+
+// isNsHost tells whether name is the nameserver the NS record of its zone
+// points at, and g53 knows the address of that nameserver.
+func (s *DNSServer) isNsHost(name string) bool {
+	zone, ok := s.zones.find(name)
+	return ok && len(s.nsAddrs) > 0 && strings.ToLower(dns.Fqdn(name)) == strings.ToLower(zone.Ns)
+}
+
+// createNsHost returns the records of type qtype for the address of the
+// nameserver name, or nothing when name isn't the nameserver of its zone.
+// Records stored for it take precedence, callers only get there without.
+func (s *DNSServer) createNsHost(name string, qtype uint16) []dns.RR {
+	if !s.isNsHost(name) {
+		return nil
+	}
+	zone, _ := s.zones.find(name)
+	var result []dns.RR
+	hdr := dns.RR_Header{Name: zone.Ns, Rrtype: qtype, Class: dns.ClassINET, Ttl: uint32(s.defaultTTL(zone.Name))}
+	for _, ip := range s.nsAddrs {
+		switch {
+		case qtype == dns.TypeA && ip.To4() != nil:
+			result = append(result, &dns.A{Hdr: hdr, A: ip.To4()})
+		case qtype == dns.TypeAAAA && ip.To4() == nil:
+			result = append(result, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return result
+}
@@ -1,8 +1,14 @@
 package servers
 
 import (
+	"fmt"
 	"github.com/hawkingrei/g53/utils"
 	"github.com/miekg/dns"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -231,3 +237,1233 @@ func TestServiceManagement(t *testing.T) {
 	*/
 
 }
+
+func TestDNSPrivateAAAA(t *testing.T) {
+	const TestAddr = "127.0.0.1:9956"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.1", Aliases: "v4.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "AAAA", TTL: 600, Value: "fd00::1", Aliases: "v6.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.2", Aliases: "dual.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "AAAA", TTL: 600, Value: "fd00::2", Aliases: "dual.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "v6.suphawking.com", Aliases: "alias.suphawking.com"})
+
+	var inputs = []struct {
+		query    string
+		qType    string
+		expected []string
+	}{
+		{"v4.suphawking.com.", "A", []string{"A"}},
+		{"v4.suphawking.com.", "AAAA", []string{}},
+		{"v6.suphawking.com.", "AAAA", []string{"AAAA"}},
+		{"v6.suphawking.com.", "A", []string{}},
+		{"dual.suphawking.com.", "AAAA", []string{"AAAA"}},
+		{"dual.suphawking.com.", "A", []string{"A"}},
+		{"alias.suphawking.com.", "AAAA", []string{"CNAME", "AAAA"}},
+		{"alias.suphawking.com.", "A", []string{"CNAME"}},
+	}
+
+	c := new(dns.Client)
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.StringToType[input.qType])
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Error(input, "Rcode expected: NOERROR got:", dns.RcodeToString[r.Rcode])
+		}
+		if len(r.Answer) != len(input.expected) {
+			t.Error(input, "Expected:", len(input.expected), "answers Got:", r.Answer)
+			continue
+		}
+		for i := range r.Answer {
+			if rrType := dns.TypeToString[r.Answer[i].Header().Rrtype]; rrType != input.expected[i] {
+				t.Error(input, "Expected:", input.expected[i], "Got:", rrType)
+			}
+		}
+		if len(r.Answer) == 0 && (len(r.Ns) == 0 || r.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Error(input, "Expected a SOA record in the authority section for NODATA")
+		}
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSPrivateMXSRV(t *testing.T) {
+	const TestAddr = "127.0.0.1:9957"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "MX", TTL: 600, Preference: 10, Target: "mx1.suphawking.com", Aliases: "suphawking.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.25", Aliases: "mx1.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "SRV", TTL: 600, Priority: 1, Weight: 5, Port: 8300, Target: "consul.suphawking.com", Aliases: "_consul._tcp.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "AAAA", TTL: 600, Value: "fd00::8300", Aliases: "consul.suphawking.com"})
+
+	c := new(dns.Client)
+
+	m := new(dns.Msg)
+	m.SetQuestion("suphawking.com.", dns.TypeMX)
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected one MX record Got:", r.Answer)
+	}
+	if mx, ok := r.Answer[0].(*dns.MX); !ok || mx.Preference != 10 || mx.Mx != "mx1.suphawking.com." {
+		t.Error("Unexpected MX record:", r.Answer[0])
+	}
+	if len(r.Extra) != 1 || r.Extra[0].Header().Rrtype != dns.TypeA {
+		t.Error("Expected the A record of the exchange as glue Got:", r.Extra)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("_consul._tcp.suphawking.com.", dns.TypeSRV)
+	r, _, err = c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected one SRV record Got:", r.Answer)
+	}
+	if srv, ok := r.Answer[0].(*dns.SRV); !ok || srv.Priority != 1 || srv.Weight != 5 || srv.Port != 8300 || srv.Target != "consul.suphawking.com." {
+		t.Error("Unexpected SRV record:", r.Answer[0])
+	}
+	if len(r.Extra) != 1 || r.Extra[0].Header().Rrtype != dns.TypeAAAA {
+		t.Error("Expected the AAAA record of the target as glue Got:", r.Extra)
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSPrivateGeneric(t *testing.T) {
+	const TestAddr = "127.0.0.1:9958"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "TXT", TTL: 600, Value: `"v=spf1 -all"`, Aliases: "api.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "CAA", TTL: 600, Value: `0 issue "letsencrypt.org"`, Aliases: "api.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "TXT", TTL: 600, Value: `"unterminated`, Aliases: "bad.suphawking.com"})
+
+	c := new(dns.Client)
+	m := new(dns.Msg)
+	m.SetQuestion("api.suphawking.com.", dns.TypeTXT)
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected one TXT record Got:", r.Answer)
+	}
+	if txt, ok := r.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != "v=spf1 -all" || txt.Hdr.Ttl != 600 {
+		t.Error("Unexpected TXT record:", r.Answer[0])
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("api.suphawking.com.", dns.TypeCAA)
+	r, _, err = c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Fatal("Expected one CAA record Got:", r.Answer)
+	}
+	if caa, ok := r.Answer[0].(*dns.CAA); !ok || caa.Tag != "issue" || caa.Value != "letsencrypt.org" {
+		t.Error("Unexpected CAA record:", r.Answer[0])
+	}
+
+	if len(server.GetAllServices()) != 2 {
+		t.Error("Invalid presentation format should be ignored Got:", server.GetAllServices())
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSReverse(t *testing.T) {
+	const TestAddr = "127.0.0.1:9959"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.ReverseCIDRs.Set("10.0.0.0/8,fd00::/8")
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.1.2.3", Aliases: "web1.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "AAAA", TTL: 600, Value: "fd00::1", Aliases: "web1.suphawking.com"})
+
+	var inputs = []struct {
+		query    string
+		qType    string
+		expected string
+		rcode    int
+	}{
+		{"3.2.1.10.in-addr.arpa.", "PTR", "web1.suphawking.com.", dns.RcodeSuccess},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", "PTR", "web1.suphawking.com.", dns.RcodeSuccess},
+		{"3.2.1.10.in-addr.arpa.", "TXT", "", dns.RcodeSuccess},
+		{"4.2.1.10.in-addr.arpa.", "PTR", "", dns.RcodeNameError},
+	}
+
+	c := new(dns.Client)
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.StringToType[input.qType])
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if r.Rcode != input.rcode {
+			t.Error(input, "Rcode expected:", dns.RcodeToString[input.rcode], "got:", dns.RcodeToString[r.Rcode])
+		}
+		if !r.Authoritative {
+			t.Error(input, "Expected an authoritative answer")
+		}
+		if input.expected == "" {
+			if len(r.Answer) != 0 {
+				t.Error(input, "Expected no answer Got:", r.Answer)
+			}
+			continue
+		}
+		if len(r.Answer) != 1 {
+			t.Error(input, "Expected one PTR record Got:", r.Answer)
+			continue
+		}
+		if ptr, ok := r.Answer[0].(*dns.PTR); !ok || ptr.Ptr != input.expected {
+			t.Error(input, "Expected:", input.expected, "Got:", r.Answer[0])
+		}
+	}
+
+	// names of the reverse zones without an address of their own
+	var partials = []struct {
+		query  string
+		qType  string
+		rcode  int
+		answer uint16
+		zone   string
+	}{
+		{"10.in-addr.arpa.", "SOA", dns.RcodeSuccess, dns.TypeSOA, "10.in-addr.arpa."},
+		{"10.in-addr.arpa.", "NS", dns.RcodeSuccess, dns.TypeNS, "10.in-addr.arpa."},
+		{"2.1.10.in-addr.arpa.", "PTR", dns.RcodeSuccess, 0, "10.in-addr.arpa."},
+		{"9.10.in-addr.arpa.", "PTR", dns.RcodeNameError, 0, "10.in-addr.arpa."},
+		{"0.d.f.ip6.arpa.", "PTR", dns.RcodeSuccess, 0, "d.f.ip6.arpa."},
+		{"1.d.f.ip6.arpa.", "SOA", dns.RcodeNameError, 0, "d.f.ip6.arpa."},
+	}
+	for _, input := range partials {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.StringToType[input.qType])
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if r.Rcode != input.rcode || !r.Authoritative {
+			t.Error(input, "Expected an authoritative", dns.RcodeToString[input.rcode], "Got:", r)
+		}
+		records := r.Answer
+		if input.answer == 0 {
+			if len(r.Answer) != 0 {
+				t.Error(input, "Expected no answer Got:", r.Answer)
+			}
+			records = r.Ns
+		}
+		if len(records) != 1 || records[0].Header().Name != input.zone {
+			t.Error(input, "Expected a record of", input.zone, "Got:", records)
+		} else if input.answer != 0 && records[0].Header().Rrtype != input.answer {
+			t.Error(input, "Expected a", dns.TypeToString[input.answer], "record Got:", records[0])
+		}
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSPrivateWildcard(t *testing.T) {
+	const TestAddr = "127.0.0.1:9960"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.1", Aliases: "*.preview.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.2", Aliases: "main.preview.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "TXT", TTL: 600, Value: `"owner"`, Aliases: "host.sub.preview.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "feature-1.preview.suphawking.com", Aliases: "latest.suphawking.com"})
+
+	var inputs = []struct {
+		query    string
+		qType    string
+		expected []string
+	}{
+		{"feature-1.preview.suphawking.com.", "A", []string{"10.0.0.1"}},
+		{"a.b.c.preview.suphawking.com.", "A", []string{"10.0.0.1"}},
+		{"main.preview.suphawking.com.", "A", []string{"10.0.0.2"}},
+		{"FEATURE-2.preview.suphawking.com.", "A", []string{"10.0.0.1"}},
+		{"latest.suphawking.com.", "A", []string{"feature-1.preview.suphawking.com.", "10.0.0.1"}},
+		{"feature-1.preview.suphawking.com.", "AAAA", []string{}},
+	}
+
+	c := new(dns.Client)
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.StringToType[input.qType])
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if r.Rcode != dns.RcodeSuccess {
+			t.Error(input, "Rcode expected: NOERROR got:", dns.RcodeToString[r.Rcode])
+		}
+		if len(r.Answer) != len(input.expected) {
+			t.Error(input, "Expected:", input.expected, "Got:", r.Answer)
+			continue
+		}
+		for i, rr := range r.Answer {
+			var value string
+			switch v := rr.(type) {
+			case *dns.A:
+				value = v.A.String()
+			case *dns.CNAME:
+				value = v.Target
+			}
+			if value != input.expected[i] {
+				t.Error(input, "Expected:", input.expected[i], "Got:", rr)
+			}
+		}
+		if len(r.Answer) != 0 && r.Answer[0].Header().Name != input.query {
+			t.Error(input, "Expected the owner to be the query name Got:", r.Answer[0].Header().Name)
+		}
+	}
+
+	// The closest encloser sub.preview.suphawking.com. has no wildcard
+	for _, name := range []string{"sub.preview.suphawking.com.", "other.sub.preview.suphawking.com."} {
+		if _, ok := server.privateLookup(name); ok {
+			t.Error(name, "should not be matched by *.preview.suphawking.com.")
+		}
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSAuthoritative(t *testing.T) {
+	const TestAddr = "127.0.0.1:9961"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	// Nothing may be forwarded, so there is no nameserver to forward to
+	config.Nameservers = []string{}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.1", Aliases: "web.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.2", Aliases: "db.internal.suphawking.com"})
+	server.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "gone.suphawking.com", Aliases: "dangling.suphawking.com"})
+
+	var inputs = []struct {
+		query   string
+		qType   string
+		answers int
+		rcode   int
+	}{
+		{"web.suphawking.com.", "A", 1, dns.RcodeSuccess},
+		{"web.suphawking.com.", "MX", 0, dns.RcodeSuccess},
+		{"unknown.suphawking.com.", "A", 0, dns.RcodeNameError},
+		{"UNKNOWN.SUPHAWKING.COM.", "AAAA", 0, dns.RcodeNameError},
+		{"internal.suphawking.com.", "A", 0, dns.RcodeSuccess},
+		{"suphawking.com.", "A", 0, dns.RcodeSuccess},
+		{"suphawking.com.", "SOA", 1, dns.RcodeSuccess},
+		{"web.suphawking.com.", "SOA", 0, dns.RcodeSuccess},
+		{"dangling.suphawking.com.", "A", 1, dns.RcodeNameError},
+		{"g53.suphawking.com.", "A", 1, dns.RcodeSuccess},
+		{"g53.suphawking.com.", "AAAA", 0, dns.RcodeSuccess},
+	}
+
+	c := new(dns.Client)
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.StringToType[input.qType])
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			break
+		}
+		if r.Rcode != input.rcode {
+			t.Error(input, "Rcode expected:", dns.RcodeToString[input.rcode], "got:", dns.RcodeToString[r.Rcode])
+		}
+		if !r.Authoritative {
+			t.Error(input, "Expected the AA bit to be set")
+		}
+		if len(r.Answer) != input.answers {
+			t.Error(input, "Expected:", input.answers, "answers Got:", r.Answer)
+		}
+		if input.answers == 0 && (len(r.Ns) != 1 || r.Ns[0].Header().Rrtype != dns.TypeSOA) {
+			t.Error(input, "Expected the SOA record in the authority section Got:", r.Ns)
+		}
+	}
+
+	// the nameserver of the zone has the address of the listener
+	m := new(dns.Msg)
+	m.SetQuestion("suphawking.com.", dns.TypeNS)
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil || len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "g53.suphawking.com." {
+		t.Fatal("Expected the NS record of the zone Got:", r, err)
+	}
+	if len(r.Extra) != 1 || r.Extra[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Error("Expected the address of the listener as glue Got:", r.Extra)
+	}
+
+	// private records outside of our zones aren't authoritative
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.3", Aliases: "web.example.org"})
+	for _, qType := range []uint16{dns.TypeA, dns.TypeMX} {
+		m := new(dns.Msg)
+		m.SetQuestion("web.example.org.", qType)
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		if r.Rcode != dns.RcodeSuccess || r.Authoritative || len(r.Ns) != 0 {
+			t.Error(dns.TypeToString[qType], "Expected a non authoritative answer without SOA Got:", r)
+		}
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSZones(t *testing.T) {
+	const TestAddr = "127.0.0.1:9962"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	if err := server.AddZone(utils.Zone{Name: "Dev.Example.Com", Ttl: 60, Refresh: 100, Serial: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddZone(utils.Zone{}); err == nil {
+		t.Error("Zone without name should fail")
+	}
+	if zones := server.GetAllZones(); len(zones) != 2 || zones[0].Name != "dev.example.com." || zones[1].Name != "suphawking.com." {
+		t.Error("Expected: dev.example.com. and suphawking.com. Got:", zones)
+	}
+
+	c := new(dns.Client)
+	soa := func(name string) *dns.SOA {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeSOA)
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil || len(r.Answer) != 1 {
+			t.Fatal("Expected a SOA record for", name, r, err)
+		}
+		return r.Answer[0].(*dns.SOA)
+	}
+
+	if record := soa("dev.example.com."); record.Serial != 10 || record.Refresh != 100 || record.Ns != "g53.dev.example.com." {
+		t.Error("Unexpected SOA record:", record)
+	}
+	server.AddService(utils.Service{RecordType: "A", TTL: -1, Value: "10.0.0.1", Aliases: "web.dev.example.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.53", Aliases: "g53.dev.example.com"})
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "10.0.0.53", Aliases: "g53.dev.example.com"})
+	server.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "web.dev.example.com", Aliases: "g53.dev.example.com"})
+	if record := soa("dev.example.com."); record.Serial != 12 {
+		t.Error("Expected serial 12 after two changes Got:", record.Serial)
+	}
+	if record := soa("suphawking.com."); record.Serial == 12 {
+		t.Error("Changes in dev.example.com. should not touch suphawking.com.")
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("web.dev.example.com.", dns.TypeA)
+	r, _, err := c.Exchange(m, TestAddr)
+	if err != nil || len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 60 {
+		t.Error("Expected the default TTL of the zone Got:", r, err)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("dev.example.com.", dns.TypeNS)
+	r, _, err = c.Exchange(m, TestAddr)
+	if err != nil || len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "g53.dev.example.com." {
+		t.Fatal("Expected the NS record of the zone Got:", r, err)
+	}
+	if len(r.Extra) != 1 || r.Extra[0].(*dns.A).A.String() != "10.0.0.53" {
+		t.Error("Expected the address of the nameserver as glue Got:", r.Extra)
+	}
+
+	m = new(dns.Msg)
+	m.SetQuestion("unknown.dev.example.com.", dns.TypeA)
+	r, _, err = c.Exchange(m, TestAddr)
+	if err != nil || r.Rcode != dns.RcodeNameError || len(r.Ns) != 1 || r.Ns[0].Header().Name != "dev.example.com." {
+		t.Error("Expected NXDOMAIN with the SOA of dev.example.com. Got:", r, err)
+	}
+
+	if err := server.RemoveZone("dev.example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := server.RemoveZone("dev.example.com"); err == nil {
+		t.Error("Removing a missing zone should fail")
+	}
+
+	// without any zone nothing is authoritative and no SOA is made up
+	if err := server.RemoveZone("suphawking.com"); err != nil {
+		t.Error(err)
+	}
+	m = new(dns.Msg)
+	m.SetQuestion("web.dev.example.com.", dns.TypeMX)
+	r, _, err = c.Exchange(m, TestAddr)
+	if err != nil || r.Rcode != dns.RcodeSuccess || r.Authoritative || len(r.Ns) != 0 {
+		t.Error("Expected NODATA without SOA Got:", r, err)
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSTCPAndTruncation(t *testing.T) {
+	const TestAddr = "127.0.0.1:9963"
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.TcpIdleTimeout = time.Second
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	for i := 0; i < 100; i++ {
+		server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: fmt.Sprintf("10.0.%d.%d", i/250, i%250+1), Aliases: "big.suphawking.com"})
+	}
+
+	var inputs = []struct {
+		net       string
+		udpSize   uint16
+		truncated bool
+	}{
+		{"udp", 0, true},
+		{"udp", 1232, true},
+		{"udp", 4096, false},
+		{"tcp", 0, false},
+	}
+	for _, input := range inputs {
+		c := &dns.Client{Net: input.net}
+		m := new(dns.Msg)
+		m.SetQuestion("big.suphawking.com.", dns.TypeA)
+		if input.udpSize != 0 {
+			m.SetEdns0(input.udpSize, false)
+		}
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error(input, "Error response from the server", err)
+			continue
+		}
+		if r.Truncated != input.truncated {
+			t.Error(input, "Expected TC:", input.truncated, "Got:", r.Truncated)
+		}
+		if !input.truncated && len(r.Answer) != 100 {
+			t.Error(input, "Expected 100 answers Got:", len(r.Answer))
+		}
+		r.Compress = true
+		if size := int(input.udpSize); input.truncated && r.Len() > size && r.Len() > dns.MinMsgSize {
+			t.Error(input, "Reply is larger than the buffer size:", r.Len())
+		}
+	}
+
+	// Pipelined queries on a single connection
+	conn, err := dns.Dial("tcp", TestAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"big.suphawking.com.", "unknown.suphawking.com."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if err := conn.WriteMsg(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, rcode := range []int{dns.RcodeSuccess, dns.RcodeNameError} {
+		r, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != rcode {
+			t.Error("Rcode expected:", dns.RcodeToString[rcode], "got:", dns.RcodeToString[r.Rcode])
+		}
+	}
+
+	// Idle connections are closed by the server
+	time.Sleep(1500 * time.Millisecond)
+	m := new(dns.Msg)
+	m.SetQuestion("big.suphawking.com.", dns.TypeA)
+	conn.WriteMsg(m)
+	if _, err := conn.ReadMsg(); err == nil {
+		t.Error("Idle connection should have been closed")
+	}
+	conn.Close()
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+// startFakeUpstream serves handler on addr over UDP and TCP, standing in
+// for the nameservers g53 forwards to.
+func startFakeUpstream(addr string, handler dns.HandlerFunc) func() {
+	udp := &dns.Server{Addr: addr, Net: "udp", Handler: handler}
+	tcp := &dns.Server{Addr: addr, Net: "tcp", Handler: handler}
+	go udp.ListenAndServe()
+	go tcp.ListenAndServe()
+	time.Sleep(100 * time.Millisecond)
+	return func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func TestDNSEdns(t *testing.T) {
+	const TestAddr = "127.0.0.1:9964"
+	const UpstreamAddr = "127.0.0.1:9965"
+
+	var lock sync.Mutex
+	var upstreamDO []bool
+	// forwarded returns the DO bits of the queries the upstream got so far
+	forwarded := func() []bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]bool{}, upstreamDO...)
+	}
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		opt := r.IsEdns0()
+		lock.Lock()
+		upstreamDO = append(upstreamDO, opt != nil && opt.Do())
+		lock.Unlock()
+		m.SetEdns0(512, opt != nil && opt.Do())
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	exchange := func(name string, edns bool, do bool, version uint8) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		if edns {
+			m.SetEdns0(4096, do)
+			m.IsEdns0().SetVersion(version)
+		}
+		r, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Error response from the server", err)
+		}
+		return r
+	}
+
+	r := exchange("www.example.org.", true, false, 1)
+	if r.Rcode != dns.RcodeBadVers || r.IsEdns0() == nil || r.IsEdns0().Version() != 0 {
+		t.Error("Expected BADVERS with an OPT record of version 0 Got:", r)
+	}
+
+	r = exchange("www.example.org.", false, false, 0)
+	if r.IsEdns0() != nil {
+		t.Error("No OPT record expected without EDNS in the query Got:", r.Extra)
+	}
+	if do := forwarded(); len(do) != 1 || do[0] {
+		t.Error("Expected a forwarded query without DO Got:", do)
+	}
+
+	r = exchange("www.example.org.", true, false, 0)
+	if opt := r.IsEdns0(); opt == nil || opt.UDPSize() != ednsBufferSize || opt.Do() {
+		t.Error("Expected our own OPT record Got:", r.Extra)
+	}
+	if len(forwarded()) != 1 {
+		t.Error("Second query without DO should come from the cache")
+	}
+
+	r = exchange("www.example.org.", true, true, 0)
+	if opt := r.IsEdns0(); opt == nil || opt.UDPSize() != ednsBufferSize || !opt.Do() {
+		t.Error("Expected our own OPT record with DO Got:", r.Extra)
+	}
+	if do := forwarded(); len(do) != 2 || !do[1] {
+		t.Error("Expected a forwarded query with DO Got:", do)
+	}
+	for _, rr := range r.Extra {
+		if opt, ok := rr.(*dns.OPT); ok && opt.UDPSize() == 512 {
+			t.Error("The OPT record of the upstream should not be passed on")
+		}
+	}
+
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSConditionalForwarding(t *testing.T) {
+	const TestAddr = "127.0.0.1:9968"
+	const DefaultAddr = "127.0.0.1:9969"
+	const CorpAddr = "127.0.0.1:9970"
+	const TeamAddr = "127.0.0.1:9971"
+
+	answerWith := func(ip string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + ip)
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		}
+	}
+	defer startFakeUpstream(DefaultAddr, answerWith("192.0.2.1"))()
+	defer startFakeUpstream(CorpAddr, answerWith("192.0.2.2"))()
+	defer startFakeUpstream(TeamAddr, answerWith("192.0.2.3"))()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{DefaultAddr}
+	corp, _ := utils.ParseForwarder("corp.example.com=" + CorpAddr)
+	config.Forwarders = []utils.Forwarder{corp}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddForwarder(utils.Forwarder{Domain: "team.corp.example.com", Nameservers: []string{TeamAddr}})
+	server.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "db.corp.example.com", Aliases: "db.suphawking.com"})
+
+	var inputs = []struct {
+		query    string
+		expected []string
+	}{
+		{"www.example.com.", []string{"192.0.2.1"}},
+		{"corp.example.com.", []string{"192.0.2.2"}},
+		{"www.corp.example.com.", []string{"192.0.2.2"}},
+		{"www.team.corp.example.com.", []string{"192.0.2.3"}},
+		{"www.notcorp.example.com.", []string{"192.0.2.1"}},
+		{"db.suphawking.com.", []string{"db.corp.example.com.", "192.0.2.2"}},
+	}
+	c := new(dns.Client)
+	for _, input := range inputs {
+		m := new(dns.Msg)
+		m.SetQuestion(input.query, dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Error("Error response from the server", err)
+			continue
+		}
+		actual := []string{}
+		for _, rr := range in.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				actual = append(actual, v.A.String())
+			case *dns.CNAME:
+				actual = append(actual, v.Target)
+			}
+		}
+		if fmt.Sprint(actual) != fmt.Sprint(input.expected) {
+			t.Error(input.query, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+
+	// Without its rule, a domain falls back to the default nameservers
+	server.RemoveForwarder("team.corp.example.com.")
+	m := new(dns.Msg)
+	m.SetQuestion("api.team.corp.example.com.", dns.TypeA)
+	if in, _, err := c.Exchange(m, TestAddr); err != nil || len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Error("Expected the corp nameserver to answer, got:", in, err)
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSCoalescing(t *testing.T) {
+	const TestAddr = "127.0.0.1:9972"
+	const UpstreamAddr = "127.0.0.1:9973"
+
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	const clients = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			name := "popular.example.com."
+			if i%2 == 1 {
+				name = "Popular.Example.com."
+			}
+			m.SetQuestion(name, dns.TypeA)
+			in, _, err := new(dns.Client).Exchange(m, TestAddr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if in.Id != m.Id || in.Question[0].Name != name || len(in.Answer) != 1 {
+				errs <- fmt.Errorf("unexpected answer %v to %v", in, m)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 1 {
+		t.Error("Expected one upstream query, got", n)
+	}
+	if stats := server.GetStats(); stats.Forwarded != 1 || stats.Coalesced != clients-1 {
+		t.Error("Unexpected stats:", stats)
+	}
+
+	// queries with the DO bit are not coalesced with the others
+	m := new(dns.Msg)
+	m.SetQuestion("popular.example.com.", dns.TypeA)
+	m.SetEdns0(4096, true)
+	if _, _, err := new(dns.Client).Exchange(m, TestAddr); err != nil {
+		t.Error(err)
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 2 {
+		t.Error("Expected a second upstream query, got", n)
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSServeStale(t *testing.T) {
+	const TestAddr = "127.0.0.1:9974"
+	const UpstreamAddr = "127.0.0.1:9975"
+
+	answerWith := func(ip string, ttl int, delay time.Duration) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			time.Sleep(delay)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			rr, _ := dns.NewRR(fmt.Sprintf("%s %d IN A %s", r.Question[0].Name, ttl, ip))
+			m.Answer = append(m.Answer, rr)
+			w.WriteMsg(m)
+		}
+	}
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.ServeStale = time.Hour
+	config.StaleAnswerTimeout = 200 * time.Millisecond
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	query := func() (string, uint32) {
+		m := new(dns.Msg)
+		m.SetQuestion("stale.example.com.", dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil || len(in.Answer) != 1 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+		return in.Answer[0].(*dns.A).A.String(), in.Answer[0].Header().Ttl
+	}
+
+	// the answer expires right away
+	stop := startFakeUpstream(UpstreamAddr, answerWith("192.0.2.1", 1, 0))
+	if ip, _ := query(); ip != "192.0.2.1" {
+		t.Error("Expected the upstream answer, got", ip)
+	}
+	stop()
+
+	// the upstream is unreachable
+	if ip, ttl := query(); ip != "192.0.2.1" || ttl != 30 {
+		t.Error("Expected the stale answer, got", ip, ttl)
+	}
+
+	// the upstream answers SERVFAIL, which is only passed on without a
+	// stale answer
+	stop = startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	if ip, ttl := query(); ip != "192.0.2.1" || ttl != 30 {
+		t.Error("Expected the stale answer, got", ip, ttl)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion("fresh.example.com.", dns.TypeA)
+	if in, _, err := c.Exchange(m, TestAddr); err != nil || in.Rcode != dns.RcodeServerFailure {
+		t.Error("Expected the SERVFAIL of the upstream, got", in, err)
+	}
+	stop()
+
+	// the upstream is slow, the stale answer is served while the cache is
+	// refreshed
+	stop = startFakeUpstream(UpstreamAddr, answerWith("192.0.2.2", 300, 500*time.Millisecond))
+	defer stop()
+	start := time.Now()
+	if ip, ttl := query(); ip != "192.0.2.1" || ttl != 30 || time.Since(start) > 400*time.Millisecond {
+		t.Error("Expected the stale answer before the upstream one, got", ip, ttl, time.Since(start))
+	}
+	time.Sleep(500 * time.Millisecond)
+	if ip, _ := query(); ip != "192.0.2.2" {
+		t.Error("Expected the refreshed answer, got", ip)
+	}
+	if stats := server.GetStats(); stats.Stale != 3 {
+		t.Error("Unexpected stats:", stats)
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSPrefetch(t *testing.T) {
+	const TestAddr = "127.0.0.1:9976"
+	const UpstreamAddr = "127.0.0.1:9977"
+
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		n := atomic.AddInt32(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(fmt.Sprintf("%s 4 IN A 192.0.2.%d", r.Question[0].Name, n))
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.PrefetchHits = 2
+	config.PrefetchPercent = 50
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	query := func() string {
+		m := new(dns.Msg)
+		m.SetQuestion("hot.example.com.", dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil || len(in.Answer) != 1 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+		return in.Answer[0].(*dns.A).A.String()
+	}
+	for i := 0; i < 3; i++ {
+		query()
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 1 {
+		t.Error("Expected the answer to be cached, got", n, "upstream queries")
+	}
+
+	// in the last half of the TTL the cached answer is served and refreshed
+	time.Sleep(2100 * time.Millisecond)
+	if ip := query(); ip != "192.0.2.1" {
+		t.Error("Expected the cached answer, got", ip)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if ip := query(); ip != "192.0.2.2" {
+		t.Error("Expected the prefetched answer, got", ip)
+	}
+	if stats := server.GetStats(); stats.Prefetched != 1 || stats.Forwarded != 2 {
+		t.Error("Unexpected stats:", stats)
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSPrefetchFailing(t *testing.T) {
+	const TestAddr = "127.0.0.1:9988"
+	const UpstreamAddr = "127.0.0.1:9989"
+
+	// only the first query is answered, refreshes time out
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		if atomic.AddInt32(&upstreamQueries, 1) > 1 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 4 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.UpstreamTimeout = 100 * time.Millisecond
+	config.PrefetchHits = 1
+	config.PrefetchPercent = 50
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("hot.example.com.", dns.TypeA)
+		if in, _, err := c.Exchange(m, TestAddr); err != nil || len(in.Answer) != 1 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+	}
+	query()
+	query()
+
+	// hits after a failed refresh don't start another one
+	time.Sleep(2100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		query()
+		time.Sleep(150 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 2 {
+		t.Error("Expected a single refresh, got", n, "upstream queries")
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSNegativeCaching(t *testing.T) {
+	const TestAddr = "127.0.0.1:9978"
+	const UpstreamAddr = "127.0.0.1:9979"
+
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		soa, _ := dns.NewRR("example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 300")
+		m.Ns = append(m.Ns, soa)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.MaxNegativeTTL = 120 * time.Second
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	for i := 0; i < 3; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion("missing.example.com.", dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if in.Rcode != dns.RcodeNameError || len(in.Answer) != 0 || len(in.Ns) != 1 {
+			t.Error("Expected NXDOMAIN with a SOA, got:", in)
+		} else if ttl := in.Ns[0].Header().Ttl; i > 0 && ttl > 120 {
+			t.Error("Expected the cached TTL to be bounded by the max negative TTL, got", ttl)
+		}
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 1 {
+		t.Error("Expected the negative answer to be cached, got", n, "upstream queries")
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSCachePolicy(t *testing.T) {
+	const TestAddr = "127.0.0.1:9980"
+	const UpstreamAddr = "127.0.0.1:9981"
+
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 3600 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.CacheMaxTTL = 600 * time.Second
+	config.CacheRules = []utils.CacheRule{
+		{Domain: "example.com.", MaxTTL: 0},
+		{Domain: "cdn.example.com.", MaxTTL: 60 * time.Second},
+	}
+
+	server := NewDNSServer(config)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	c := new(dns.Client)
+	var tests = []struct {
+		name    string
+		ttl     uint32
+		queries int32
+	}{
+		{"www.example.org.", 3600, 1},
+		{"www.example.org.", 600, 1},
+		{"img.cdn.example.com.", 3600, 2},
+		{"img.cdn.example.com.", 60, 2},
+		{"www.example.com.", 3600, 3},
+		{"www.example.com.", 3600, 4},
+	}
+	for _, input := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(input.name, dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil || len(in.Answer) != 1 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+		if in.Answer[0].Header().Ttl != input.ttl {
+			t.Error(input.name, "Expected TTL:", input.ttl, "Got:", in.Answer[0].Header().Ttl)
+		}
+		if n := atomic.LoadInt32(&upstreamQueries); n != input.queries {
+			t.Error(input.name, "Expected", input.queries, "upstream queries, got", n)
+		}
+	}
+	server.Stop()
+	time.Sleep(250 * time.Millisecond)
+}
+
+func TestDNSCacheFile(t *testing.T) {
+	const TestAddr = "127.0.0.1:9986"
+	const UpstreamAddr = "127.0.0.1:9987"
+
+	var upstreamQueries int32
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&upstreamQueries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	dir, err := ioutil.TempDir("", "g53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+	config.CacheFile = filepath.Join(dir, "cache")
+
+	c := new(dns.Client)
+	query := func() {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		in, _, err := c.Exchange(m, TestAddr)
+		if err != nil || len(in.Answer) != 1 {
+			t.Fatal("Unexpected answer:", in, err)
+		}
+	}
+
+	// the cache is saved when the server stops and loaded when it starts
+	for i := 0; i < 2; i++ {
+		server := NewDNSServer(config)
+		go server.Start()
+		time.Sleep(250 * time.Millisecond)
+		query()
+		server.Stop()
+		time.Sleep(250 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&upstreamQueries); n != 1 {
+		t.Error("Expected the answer to be loaded from the cache file, got", n, "upstream queries")
+	}
+}
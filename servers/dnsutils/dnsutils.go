@@ -3,7 +3,10 @@ package dnsutils
 import (
 	"errors"
 	"github.com/hawkingrei/g53/cache"
+	"github.com/hawkingrei/g53/cache/simplemsglru"
 	"github.com/miekg/dns"
+	"net"
+	"strings"
 	"time"
 )
 
@@ -14,65 +17,102 @@ func Round(val float64) uint32 {
 	return uint32(val + 0.5)
 }
 
-func QueryDnsCache(s *cache.MsgCache, r *dns.Msg) (*dns.Msg, error) {
-	m := new(dns.Msg)
-	m.Compress = true
-	m.SetReply(r)
-	m.RecursionAvailable = true
+// QueryDnsCache answers r from the cache with the remaining TTL of the
+// records. Expired records are kept for staleWindow, to be served by
+// QueryStaleCache, and removed afterwards.
+func QueryDnsCache(s *cache.MsgCache, r *dns.Msg, staleWindow time.Duration) (*dns.Msg, error) {
+	return queryCache(s, r, staleWindow, 0)
+}
+
+// QueryStaleCache answers r from the cache even if the records expired less
+// than staleWindow ago, expired records get staleTTL as TTL (RFC 8767).
+func QueryStaleCache(s *cache.MsgCache, r *dns.Msg, staleWindow time.Duration, staleTTL uint32) (*dns.Msg, error) {
+	return queryCache(s, r, staleWindow, staleTTL)
+}
 
-	name := r.Question[0].Name
-	recordType := r.Question[0].Qtype
-	result, rtime, err := s.Get(name, recordType)
+func queryCache(s *cache.MsgCache, r *dns.Msg, staleWindow time.Duration, staleTTL uint32) (*dns.Msg, error) {
+	key := simplemsglru.NewKey(r)
+	entry, err := s.Get(key)
 	if err != nil {
-		return m, err
+		return nil, err
 	}
 	nowtime := time.Now()
-	var rr []dns.RR = make([]dns.RR, len(result))
-	for v := 0; v < len(result); v++ {
-		expiration := rtime.Add(time.Duration(result[v].Header().Ttl) * time.Second)
-		if expiration.Before(nowtime) {
-			s.Remove(name, recordType)
-			return m, errors.New("expiration")
+	cttl := Round(nowtime.Sub(entry.Time).Seconds())
+	// responses are expired when less than a second remains
+	expired := entry.TTL <= cttl+1
+	if expired {
+		if entry.Expired(nowtime, staleWindow) {
+			s.Remove(key)
+			return nil, errors.New("expiration")
 		}
-	}
-	cttl := nowtime.Sub(*rtime).Seconds()
-	for v := 0; v < len(result); v++ {
-		rr[v] = dns.Copy(result[v])
-	}
-	for v := 0; v < len(rr); v++ {
-		tmp := rr[v].Header().Ttl - Round(cttl)
-		if tmp <= 1 {
-			s.Remove(name, recordType)
-			return m, errors.New("expiration")
+		if staleTTL == 0 {
+			return nil, errors.New("expiration")
 		}
-		rr[v].Header().Ttl = tmp
 	}
-	result = rr
-	if recordType == dns.TypeCNAME {
-		for v := 0; v < len(result); v++ {
-			if result[v].Header().Rrtype == dns.TypeCNAME {
-				m.Answer = append(m.Answer, result[v])
+
+	// the reply keeps the sections, rcode and flags of the cached response
+	m := entry.Msg.Copy()
+	m.Id = r.Id
+	m.Question = append([]dns.Question{}, r.Question...)
+	m.RecursionDesired = r.RecursionDesired
+	m.CheckingDisabled = r.CheckingDisabled
+	m.RecursionAvailable = true
+	m.Compress = true
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
 				continue
 			}
-			m.Extra = append(m.Extra, result[v])
+			if expired {
+				rr.Header().Ttl = staleTTL
+			} else {
+				rr.Header().Ttl = rr.Header().Ttl - cttl
+			}
 		}
-		return m, nil
 	}
+	return m, nil
+}
 
-	if recordType == dns.TypeA || recordType == dns.TypeAAAA {
-		if result[len(result)-1].Header().Rrtype != dns.TypeA && result[len(result)-1].Header().Rrtype != dns.TypeAAAA || result[len(result)-1].Header().Rrtype == dns.TypeSOA {
-			s.Remove(name, recordType)
-			return m, nil
-		}
+// NeedsPrefetch tells whether the answer to r was looked up at least
+// minHits times and is in the last percent of its TTL, so that it is worth
+// refreshing before it expires, unless its refresh was already started.
+func NeedsPrefetch(s *cache.MsgCache, r *dns.Msg, minHits uint64, percent int) bool {
+	entry, err := s.Peek(simplemsglru.NewKey(r))
+	if err != nil || entry.Hits < minHits || entry.Prefetched {
+		return false
 	}
+	ttl := entry.TTL
+	remaining := time.Duration(ttl)*time.Second - time.Since(entry.Time)
+	return remaining*100 <= time.Duration(ttl)*time.Second*time.Duration(percent)
+}
 
-	for v := 0; v < len(result); v++ {
-		if result[v].Header().Rrtype != dns.TypeSOA {
-			m.Answer = append(m.Answer, result[v])
+// ReverseZones returns the in-addr.arpa. or ip6.arpa. zones of network. A
+// network whose prefix doesn't end on a label, an octet for IPv4 and a
+// nibble for IPv6, is split into the zones of the longer prefix which does.
+func ReverseZones(network *net.IPNet) []string {
+	ones, bits := network.Mask.Size()
+	labelBits := 8
+	if bits == 8*net.IPv6len {
+		labelBits = 4
+	}
+	zoneBits := (ones + labelBits - 1) / labelBits * labelBits
+	ip := network.IP.Mask(network.Mask)
+	zones := make([]string, 0, 1<<uint(zoneBits-ones))
+	for n := 0; n < 1<<uint(zoneBits-ones); n++ {
+		addr := make(net.IP, len(ip))
+		copy(addr, ip)
+		for b := ones; b < zoneBits; b++ {
+			if n&(1<<uint(zoneBits-1-b)) != 0 {
+				addr[b/8] |= 0x80 >> uint(b%8)
+			}
+		}
+		name, err := dns.ReverseAddr(addr.String())
+		if err != nil {
 			continue
 		}
-		m.Extra = append(m.Extra, result[v])
+		// drop the labels of the host part
+		labels := dns.SplitDomainName(name)
+		zones = append(zones, strings.Join(labels[(bits-zoneBits)/labelBits:], ".")+".")
 	}
-
-	return m, nil
+	return zones
 }
@@ -1 +1,156 @@
 package dnsutils
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/g53/cache"
+	"github.com/hawkingrei/g53/cache/simplemsglru"
+	"github.com/miekg/dns"
+)
+
+func TestReverseZones(t *testing.T) {
+	var tests = map[string][]string{
+		"10.0.0.0/8":     {"10.in-addr.arpa."},
+		"192.168.1.0/24": {"1.168.192.in-addr.arpa."},
+		"192.0.2.1/32":   {"1.2.0.192.in-addr.arpa."},
+		"172.16.0.0/14":  {"16.172.in-addr.arpa.", "17.172.in-addr.arpa.", "18.172.in-addr.arpa.", "19.172.in-addr.arpa."},
+		"fd00::/8":       {"d.f.ip6.arpa."},
+		"fc00::/7":       {"c.f.ip6.arpa.", "d.f.ip6.arpa."},
+		"2001:db8::/32":  {"8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+
+	for input, expected := range tests {
+		_, network, _ := net.ParseCIDR(input)
+		if actual := ReverseZones(network); !reflect.DeepEqual(actual, expected) {
+			t.Error(input, "Expected:", expected, "Got:", actual)
+		}
+	}
+}
+
+// addReply caches the reply to r holding the records of answer
+func addReply(c *cache.MsgCache, r *dns.Msg, answer ...dns.RR) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = answer
+	c.Add(simplemsglru.NewKey(r), m)
+}
+
+func TestQueryStaleCache(t *testing.T) {
+	c, _ := cache.NewMsgCache(256)
+	rr, _ := dns.NewRR("stale.example.com. 1 IN A 192.0.2.1")
+	r := new(dns.Msg)
+	r.SetQuestion("stale.example.com.", dns.TypeA)
+
+	addReply(c, r, rr)
+	if _, err := QueryDnsCache(c, r, time.Hour); err == nil {
+		t.Error("Expected the expired record not to be served")
+	}
+	m, err := QueryStaleCache(c, r, time.Hour, 30)
+	if err != nil || len(m.Answer) != 1 || m.Answer[0].Header().Ttl != 30 {
+		t.Error("Expected the stale record with a TTL of 30, got:", m, err)
+	}
+
+	// outside of the stale window the record is removed
+	if _, err := QueryDnsCache(c, r, 0); err == nil {
+		t.Error("Expected the expired record not to be served")
+	}
+	if _, err := QueryStaleCache(c, r, time.Hour, 30); err == nil {
+		t.Error("Expected the expired record to be removed")
+	}
+
+	rr, _ = dns.NewRR("stale.example.com. 300 IN A 192.0.2.1")
+	addReply(c, r, rr)
+	if m, err := QueryStaleCache(c, r, time.Hour, 30); err != nil || m.Answer[0].Header().Ttl != 300 {
+		t.Error("Expected the fresh record to keep its TTL, got:", m, err)
+	}
+}
+
+func TestQueryDnsCache(t *testing.T) {
+	c, _ := cache.NewMsgCache(256)
+	r := new(dns.Msg)
+	r.SetQuestion("www.example.com.", dns.TypeA)
+	cname, _ := dns.NewRR("www.example.com. 300 IN CNAME web.example.net.")
+	a, _ := dns.NewRR("web.example.net. 300 IN A 192.0.2.1")
+	ns, _ := dns.NewRR("example.net. 300 IN NS ns.example.net.")
+	glue, _ := dns.NewRR("ns.example.net. 300 IN A 192.0.2.53")
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.AuthenticatedData = true
+	m.Answer = []dns.RR{cname, a}
+	m.Ns = []dns.RR{ns}
+	m.Extra = []dns.RR{glue}
+	c.Add(simplemsglru.NewKey(r), m)
+
+	q := new(dns.Msg)
+	q.SetQuestion("WWW.example.com.", dns.TypeA)
+	result, err := QueryDnsCache(c, q, 0)
+	if err != nil {
+		t.Fatal("Expected the cached response:", err)
+	}
+	if result.Id != q.Id || result.Question[0].Name != "WWW.example.com." {
+		t.Error("Expected the reply to carry the query, got:", result)
+	}
+	if !result.AuthenticatedData || len(result.Answer) != 2 || len(result.Ns) != 1 || len(result.Extra) != 1 {
+		t.Error("Expected the sections and flags of the response, got:", result)
+	}
+	if result.Answer[1] == a {
+		t.Error("Expected a copy of the cached records")
+	}
+
+	// answers with or without DNSSEC records are kept apart
+	q.SetEdns0(1232, true)
+	if _, err := QueryDnsCache(c, q, 0); err == nil {
+		t.Error("Expected no response cached for the DO bit")
+	}
+}
+
+func TestQueryDnsCacheNegative(t *testing.T) {
+	c, _ := cache.NewMsgCache(256)
+	soa, _ := dns.NewRR("example.com. 60 IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 60")
+	r := new(dns.Msg)
+	r.SetQuestion("missing.example.com.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Ns = []dns.RR{soa}
+	c.Add(simplemsglru.NewKey(r), m)
+
+	m, err := QueryDnsCache(c, r, 0)
+	if err != nil || m.Rcode != dns.RcodeNameError || len(m.Answer) != 0 || len(m.Ns) != 1 {
+		t.Fatal("Expected the cached NXDOMAIN, got:", m, err)
+	}
+	if _, ok := m.Ns[0].(*dns.SOA); !ok || m.Ns[0].Header().Ttl != 60 {
+		t.Error("Expected the SOA with its TTL, got:", m.Ns[0])
+	}
+}
+
+func TestNeedsPrefetch(t *testing.T) {
+	c, _ := cache.NewMsgCache(256)
+	rr, _ := dns.NewRR("hot.example.com. 10 IN A 192.0.2.1")
+	r := new(dns.Msg)
+	r.SetQuestion("hot.example.com.", dns.TypeA)
+
+	if NeedsPrefetch(c, r, 0, 100) {
+		t.Error("Expected missing answers not to be prefetched")
+	}
+	addReply(c, r, rr)
+	for i := 0; i < 3; i++ {
+		QueryDnsCache(c, r, 0)
+	}
+	var tests = []struct {
+		minHits  uint64
+		percent  int
+		expected bool
+	}{
+		{3, 100, true},
+		{4, 100, false},
+		{3, 50, false},
+	}
+	for _, input := range tests {
+		if actual := NeedsPrefetch(c, r, input.minHits, input.percent); actual != input.expected {
+			t.Error(input, "Expected:", input.expected, "Got:", actual)
+		}
+	}
+}
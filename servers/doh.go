@@ -0,0 +1,150 @@
+package servers
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the media type of DNS over HTTPS messages (RFC 8484)
+const dohMediaType = "application/dns-message"
+
+// dohResponseWriter captures the reply of a dns.Handler to a DNS over HTTPS
+// query.
+type dohResponseWriter struct {
+	req   *http.Request
+	reply *dns.Msg
+}
+
+// LocalAddr is the address of the listener the request came through
+func (w *dohResponseWriter) LocalAddr() net.Addr {
+	if addr, ok := w.req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+// RemoteAddr is a TCP address, HTTP replies are never truncated
+func (w *dohResponseWriter) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", w.req.RemoteAddr)
+	if addr == nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// ConnectionState lets replies over HTTPS be padded
+func (w *dohResponseWriter) ConnectionState() *tls.ConnectionState {
+	return w.req.TLS
+}
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.reply = m
+	return len(b), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// readDohQuery decodes the query of a GET request from its dns parameter
+// or the one of a POST request from its body.
+func readDohQuery(req *http.Request) (*dns.Msg, error) {
+	var buf []byte
+	var err error
+	switch req.Method {
+	case "GET":
+		param := req.URL.Query().Get("dns")
+		if param == "" {
+			return nil, errors.New("Missing dns parameter")
+		}
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	case "POST":
+		if req.Header.Get("Content-Type") != dohMediaType {
+			return nil, errors.New("Content-Type must be " + dohMediaType)
+		}
+		buf, err = ioutil.ReadAll(io.LimitReader(req.Body, dns.MaxMsgSize))
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// minTTL is the freshness lifetime of a reply, the smallest TTL of its
+// answers, or of its SOA for negative replies (RFC 8484 section 5.1).
+func minTTL(m *dns.Msg) (uint32, bool) {
+	records := m.Answer
+	if len(records) == 0 {
+		records = m.Ns
+	}
+	var maxAge uint32
+	found := false
+	for _, rr := range records {
+		ttl := rr.Header().Ttl
+		if soa, ok := rr.(*dns.SOA); ok && len(m.Answer) == 0 && soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if !found || ttl < maxAge {
+			maxAge = ttl
+			found = true
+		}
+	}
+	return maxAge, found
+}
+
+// dnsQuery answers DNS over HTTPS queries with the DNS server pipeline
+func (s *HTTPServer) dnsQuery(w http.ResponseWriter, req *http.Request) {
+	if s.resolver == nil {
+		http.Error(w, "DNS over HTTPS is not supported", http.StatusNotFound)
+		return
+	}
+	query, err := readDohQuery(req)
+	if err != nil {
+		logger.Errorf("DNS over HTTPS query error: %s", err)
+		status := http.StatusBadRequest
+		if req.Method == "POST" && req.Header.Get("Content-Type") != dohMediaType {
+			status = http.StatusUnsupportedMediaType
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	rw := &dohResponseWriter{req: req}
+	s.resolver.ServeDNS(rw, query)
+	if rw.reply == nil {
+		http.Error(w, "No reply", http.StatusInternalServerError)
+		return
+	}
+	buf, err := rw.reply.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if maxAge, ok := minTTL(rw.reply); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(maxAge), 10))
+	}
+	w.Write(buf)
+}
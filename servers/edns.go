@@ -0,0 +1,44 @@
+package servers
+
+import (
+	"github.com/miekg/dns"
+)
+
+// ednsBufferSize is the UDP payload size g53 advertises to clients and
+// upstreams, small enough to avoid IP fragmentation.
+const ednsBufferSize = 1232
+
+// isDO tells whether the client asked for DNSSEC records
+func isDO(r *dns.Msg) bool {
+	opt := r.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// upstreamMsg copies r to be forwarded, with our own OPT record carrying
+// the DO bit of the client.
+func upstreamMsg(r *dns.Msg) *dns.Msg {
+	req := r.Copy()
+	req.Extra = removeOPT(req.Extra)
+	req.SetEdns0(ednsBufferSize, isDO(r))
+	return req
+}
+
+// setEdns replaces the OPT record of m, e.g. the one of an upstream reply,
+// with ours when the client sent one itself (RFC 6891 section 7).
+func setEdns(r *dns.Msg, m *dns.Msg) {
+	m.Extra = removeOPT(m.Extra)
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(ednsBufferSize, opt.Do())
+	}
+}
+
+// removeOPT returns a copy of extra without OPT records
+func removeOPT(extra []dns.RR) []dns.RR {
+	result := make([]dns.RR, 0, len(extra))
+	for _, rr := range extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
@@ -0,0 +1,195 @@
+package servers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// explainStep is one hop of the resolution of a query
+type explainStep struct {
+	Source   string
+	Detail   string
+	Duration string
+}
+
+// explainTrace records how a query was answered. A nil trace records
+// nothing, so the resolution path can use it unconditionally.
+type explainTrace struct {
+	start time.Time
+	last  time.Time
+	Steps []explainStep
+}
+
+func newExplainTrace() *explainTrace {
+	now := time.Now()
+	return &explainTrace{start: now, last: now, Steps: []explainStep{}}
+}
+
+// add records a step with the time spent since the previous one
+func (t *explainTrace) add(source string, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.Steps = append(t.Steps, explainStep{
+		Source:   source,
+		Detail:   fmt.Sprintf(format, args...),
+		Duration: now.Sub(t.last).String(),
+	})
+	t.last = now
+}
+
+// child returns a trace for steps which may outlive the request, nil when
+// t is nil. Its steps are added to t by merge.
+func (t *explainTrace) child() *explainTrace {
+	if t == nil {
+		return nil
+	}
+	return newExplainTrace()
+}
+
+// merge appends the steps of a child trace
+func (t *explainTrace) merge(child *explainTrace) {
+	if t == nil || child == nil {
+		return
+	}
+	t.Steps = append(t.Steps, child.Steps...)
+	t.last = time.Now()
+}
+
+// MarshalJSON adds the total duration of the resolution to the steps
+func (t *explainTrace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Duration string
+		Steps    []explainStep
+	}{t.last.Sub(t.start).String(), t.Steps})
+}
+
+// traceResponseWriter captures a reply like dohResponseWriter and carries
+// the trace the DNS server records its steps into.
+type traceResponseWriter struct {
+	dohResponseWriter
+	trace *explainTrace
+}
+
+// traceOf returns the trace of w, nil unless the query is explained
+func traceOf(w dns.ResponseWriter) *explainTrace {
+	if tw, ok := w.(*traceResponseWriter); ok {
+		return tw.trace
+	}
+	return nil
+}
+
+type resolveQuestion struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type resolveRR struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32
+	Data string `json:"data"`
+}
+
+// resolveReply follows the JSON format of Google's DNS over HTTPS API,
+// with the trace of the resolution.
+type resolveReply struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Question   []resolveQuestion
+	Answer     []resolveRR `json:",omitempty"`
+	Authority  []resolveRR `json:",omitempty"`
+	Additional []resolveRR `json:",omitempty"`
+	Explain    *explainTrace
+}
+
+func toResolveRRs(records []dns.RR) []resolveRR {
+	result := []resolveRR{}
+	for _, rr := range records {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeOPT {
+			continue
+		}
+		result = append(result, resolveRR{
+			Name: hdr.Name,
+			Type: hdr.Rrtype,
+			TTL:  hdr.Ttl,
+			Data: strings.TrimPrefix(rr.String(), hdr.String()),
+		})
+	}
+	return result
+}
+
+// parseQtype accepts a type mnemonic or number, A when empty
+func parseQtype(value string) (uint16, error) {
+	if value == "" {
+		return dns.TypeA, nil
+	}
+	if qtype, ok := dns.StringToType[strings.ToUpper(value)]; ok {
+		return qtype, nil
+	}
+	qtype, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return 0, errors.New("Unknown type " + value)
+	}
+	return uint16(qtype), nil
+}
+
+// resolve answers `GET /resolve?name=foo&type=A` and explains the answer
+func (s *HTTPServer) resolve(w http.ResponseWriter, req *http.Request) {
+	if s.resolver == nil {
+		http.Error(w, "Resolving is not supported", http.StatusNotFound)
+		return
+	}
+	name := req.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	qtype, err := parseQtype(req.URL.Query().Get("type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(dns.Fqdn(name), qtype)
+	query.CheckingDisabled = req.URL.Query().Get("cd") == "1"
+
+	rw := &traceResponseWriter{dohResponseWriter{req: req}, newExplainTrace()}
+	s.resolver.ServeDNS(rw, query)
+	if rw.reply == nil {
+		http.Error(w, "No reply", http.StatusInternalServerError)
+		return
+	}
+	m := rw.reply
+	result := resolveReply{
+		Status:     m.Rcode,
+		TC:         m.Truncated,
+		RD:         m.RecursionDesired,
+		RA:         m.RecursionAvailable,
+		AD:         m.AuthenticatedData,
+		CD:         m.CheckingDisabled,
+		Question:   []resolveQuestion{},
+		Answer:     toResolveRRs(m.Answer),
+		Authority:  toResolveRRs(m.Ns),
+		Additional: toResolveRRs(m.Extra),
+		Explain:    rw.trace,
+	}
+	for _, q := range m.Question {
+		result.Question = append(result.Question, resolveQuestion{q.Name, q.Qtype})
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,75 @@
+package servers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
+)
+
+// ForwarderListProvider represents the entrypoint to manage forwarding rules
+type ForwarderListProvider interface {
+	AddForwarder(utils.Forwarder) error
+	RemoveForwarder(domain string) error
+	GetAllForwarders() []utils.Forwarder
+}
+
+// forwarderRegistry holds the forwarding rules by domain
+type forwarderRegistry struct {
+	lock       sync.RWMutex
+	forwarders map[string]utils.Forwarder
+}
+
+func newForwarderRegistry() *forwarderRegistry {
+	return &forwarderRegistry{forwarders: make(map[string]utils.Forwarder)}
+}
+
+// add registers a rule, replacing the one of the same domain
+func (f *forwarderRegistry) add(forwarder utils.Forwarder) error {
+	forwarder.Nameservers = append([]string{}, forwarder.Nameservers...)
+	if err := forwarder.SetDefaults(); err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.forwarders[forwarder.Domain] = forwarder
+	return nil
+}
+
+func (f *forwarderRegistry) remove(domain string) error {
+	domain = strings.ToLower(dns.Fqdn(domain))
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if _, ok := f.forwarders[domain]; !ok {
+		return errors.New("Forwarder doesn't exist")
+	}
+	delete(f.forwarders, domain)
+	return nil
+}
+
+// find returns the rule of the longest domain containing name
+func (f *forwarderRegistry) find(name string) (utils.Forwarder, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if forwarder, ok := f.forwarders[name[off:]]; ok {
+			return forwarder, true
+		}
+	}
+	return utils.Forwarder{}, false
+}
+
+func (f *forwarderRegistry) list() []utils.Forwarder {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	result := make([]utils.Forwarder, 0, len(f.forwarders))
+	for _, forwarder := range f.forwarders {
+		result = append(result, forwarder)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Domain < result[j].Domain })
+	return result
+}
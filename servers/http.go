@@ -3,13 +3,18 @@ package servers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/gorilla/mux"
+	"github.com/hawkingrei/g53/servers/upstream"
 	"github.com/hawkingrei/g53/utils"
 	"github.com/hawkingrei/g53/version"
+	"github.com/miekg/dns"
+	"io"
 	"net"
 	"net/http"
 	//"regexp"
 	"runtime"
+	"strings"
 )
 
 type setstruct struct {
@@ -17,11 +22,28 @@ type setstruct struct {
 	modifyValue   utils.Service
 }
 
+// UpstreamStatusProvider represents the entrypoint to the health of the
+// nameservers queries are forwarded to
+type UpstreamStatusProvider interface {
+	GetUpstreams() []upstream.Status
+}
+
+// StatsProvider represents the entrypoint to the counters of the server
+type StatsProvider interface {
+	GetStats() Stats
+}
+
 // HTTPServer represents the http endpoint
 type HTTPServer struct {
-	config *utils.Config
-	list   ServiceListProvider
-	server *http.Server
+	config      *utils.Config
+	list        ServiceListProvider
+	zones       ZoneListProvider
+	forwarders  ForwarderListProvider
+	upstreams   UpstreamStatusProvider
+	stats       StatsProvider
+	resolver    dns.Handler
+	server      *http.Server
+	httpsServer *http.Server
 }
 
 // NewHTTPServer create a new http endpoint
@@ -30,6 +52,21 @@ func NewHTTPServer(c *utils.Config, list ServiceListProvider) *HTTPServer {
 		config: c,
 		list:   list,
 	}
+	if zones, ok := list.(ZoneListProvider); ok {
+		s.zones = zones
+	}
+	if forwarders, ok := list.(ForwarderListProvider); ok {
+		s.forwarders = forwarders
+	}
+	if upstreams, ok := list.(UpstreamStatusProvider); ok {
+		s.upstreams = upstreams
+	}
+	if stats, ok := list.(StatsProvider); ok {
+		s.stats = stats
+	}
+	if resolver, ok := list.(dns.Handler); ok {
+		s.resolver = resolver
+	}
 	router := mux.NewRouter()
 	router.HandleFunc("/version", s.getVersion).Methods("GET")
 	router.HandleFunc("/services", s.getServices).Methods("GET")
@@ -37,16 +74,50 @@ func NewHTTPServer(c *utils.Config, list ServiceListProvider) *HTTPServer {
 	router.HandleFunc("/service", s.addService).Methods("PUT")
 	//router.HandleFunc("/service", s.updateService).Methods("PATCH")
 	router.HandleFunc("/service", s.removeService).Methods("DELETE")
+	router.HandleFunc("/record", s.addRecord).Methods("PUT")
+	router.HandleFunc("/record", s.removeRecord).Methods("DELETE")
+	router.HandleFunc("/zones", s.getZones).Methods("GET")
+	router.HandleFunc("/zone", s.addZone).Methods("PUT")
+	router.HandleFunc("/zone", s.removeZone).Methods("DELETE")
+	router.HandleFunc("/forwarders", s.getForwarders).Methods("GET")
+	router.HandleFunc("/forwarder", s.addForwarder).Methods("PUT")
+	router.HandleFunc("/forwarder", s.removeForwarder).Methods("DELETE")
+	router.HandleFunc("/upstreams", s.getUpstreams).Methods("GET")
+	router.HandleFunc("/stats", s.getStats).Methods("GET")
 	router.HandleFunc("/set/ttl", s.setTTL).Methods("PUT")
+	router.HandleFunc("/dns-query", s.dnsQuery).Methods("GET", "POST")
+	router.HandleFunc("/resolve", s.resolve).Methods("GET")
 
 	s.server = &http.Server{Addr: c.HttpAddr, Handler: router}
+	if c.HttpsAddr != "" {
+		// browsers and mobile clients only get DNS over HTTPS, never the
+		// API changing the records
+		dohRouter := mux.NewRouter()
+		dohRouter.HandleFunc("/dns-query", s.dnsQuery).Methods("GET", "POST")
+		s.httpsServer = &http.Server{Addr: c.HttpsAddr, Handler: dohRouter}
+	}
 
 	return s
 }
 
-// Start starts the http endpoint
+// Start starts the http endpoint, and the https one when an address is
+// configured, it returns as soon as one of them fails.
 func (s *HTTPServer) Start() error {
-	return s.server.ListenAndServe()
+	errs := make(chan error, 2)
+	if s.httpsServer != nil {
+		config, err := newTLSConfig(s.config)
+		if err != nil {
+			return err
+		}
+		s.httpsServer.TLSConfig = config
+		go func() {
+			errs <- s.httpsServer.ListenAndServeTLS("", "")
+		}()
+	}
+	go func() {
+		errs <- s.server.ListenAndServe()
+	}()
+	return <-errs
 }
 func (s *HTTPServer) getVersion(w http.ResponseWriter, req *http.Request) {
 	version := version.VersionOptions{
@@ -96,7 +167,9 @@ func (s *HTTPServer) addService(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	s.list.AddService(service)
+	if err := s.list.AddService(service); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
 }
 
 func (s *HTTPServer) removeService(w http.ResponseWriter, req *http.Request) {
@@ -112,6 +185,214 @@ func (s *HTTPServer) removeService(w http.ResponseWriter, req *http.Request) {
 
 }
 
+// addRecord registers the records of the request body, given in RFC 1035
+// presentation format, e.g. `api 300 IN TXT "v=1"`.
+func (s *HTTPServer) addRecord(w http.ResponseWriter, req *http.Request) {
+	services, err := s.parseRecords(req.Body)
+	if err != nil {
+		logger.Errorf("record parsing error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, service := range services {
+		if err := s.list.AddService(service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+func (s *HTTPServer) removeRecord(w http.ResponseWriter, req *http.Request) {
+	services, err := s.parseRecords(req.Body)
+	if err != nil {
+		logger.Errorf("record parsing error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, service := range services {
+		if err := s.list.RemoveService(service); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+}
+
+// parseRecords reads presentation format records relative to the configured
+// domain and converts them to services. Nothing is returned unless every
+// record is valid and inside one of the zones.
+func (s *HTTPServer) parseRecords(r io.Reader) ([]utils.Service, error) {
+	origin := dns.Fqdn(s.config.Domain.String())
+	services := []utils.Service{}
+	zp := dns.NewZoneParser(r, origin, "")
+	if zone, ok := s.findZone(origin); ok && zone.Ttl > 0 {
+		zp.SetDefaultTTL(uint32(zone.Ttl))
+	}
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if rr.Header().Class != dns.ClassINET {
+			return nil, fmt.Errorf("record '%s' is not of class IN", rr)
+		}
+		if _, ok := s.findZone(rr.Header().Name); !ok {
+			return nil, fmt.Errorf("record '%s' is outside of every zone", rr)
+		}
+		service := recordToService(rr)
+		if err := validateDomainValue(service); err != nil {
+			return nil, err
+		}
+		services = append(services, service)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errors.New("No record provided")
+	}
+	return services, nil
+}
+
+// findZone returns the zone containing name, only the configured domain is
+// known when the provider doesn't manage zones.
+func (s *HTTPServer) findZone(name string) (utils.Zone, bool) {
+	if s.zones != nil {
+		return s.zones.GetZone(name)
+	}
+	zone := utils.NewZone(s.config.Domain.String())
+	return zone, dns.IsSubDomain(zone.Name, strings.ToLower(name))
+}
+
+func (s *HTTPServer) getZones(w http.ResponseWriter, req *http.Request) {
+	if s.zones == nil {
+		http.Error(w, "Zones are not supported", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(s.zones.GetAllZones())
+}
+
+func (s *HTTPServer) addZone(w http.ResponseWriter, req *http.Request) {
+	if s.zones == nil {
+		http.Error(w, "Zones are not supported", http.StatusNotFound)
+		return
+	}
+	var zone utils.Zone
+	if err := json.NewDecoder(req.Body).Decode(&zone); err != nil {
+		logger.Errorf("JSON decoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.zones.AddZone(zone); err != nil {
+		logger.Errorf("validation error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *HTTPServer) removeZone(w http.ResponseWriter, req *http.Request) {
+	if s.zones == nil {
+		http.Error(w, "Zones are not supported", http.StatusNotFound)
+		return
+	}
+	var zone utils.Zone
+	if err := json.NewDecoder(req.Body).Decode(&zone); err != nil {
+		logger.Errorf("JSON decoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.zones.RemoveZone(zone.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (s *HTTPServer) getForwarders(w http.ResponseWriter, req *http.Request) {
+	if s.forwarders == nil {
+		http.Error(w, "Forwarders are not supported", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(s.forwarders.GetAllForwarders())
+}
+
+func (s *HTTPServer) getUpstreams(w http.ResponseWriter, req *http.Request) {
+	if s.upstreams == nil {
+		http.Error(w, "Upstreams are not supported", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(s.upstreams.GetUpstreams())
+}
+
+func (s *HTTPServer) getStats(w http.ResponseWriter, req *http.Request) {
+	if s.stats == nil {
+		http.Error(w, "Stats are not supported", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(s.stats.GetStats())
+}
+
+func (s *HTTPServer) addForwarder(w http.ResponseWriter, req *http.Request) {
+	if s.forwarders == nil {
+		http.Error(w, "Forwarders are not supported", http.StatusNotFound)
+		return
+	}
+	var forwarder utils.Forwarder
+	if err := json.NewDecoder(req.Body).Decode(&forwarder); err != nil {
+		logger.Errorf("JSON decoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.forwarders.AddForwarder(forwarder); err != nil {
+		logger.Errorf("validation error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *HTTPServer) removeForwarder(w http.ResponseWriter, req *http.Request) {
+	if s.forwarders == nil {
+		http.Error(w, "Forwarders are not supported", http.StatusNotFound)
+		return
+	}
+	var forwarder utils.Forwarder
+	if err := json.NewDecoder(req.Body).Decode(&forwarder); err != nil {
+		logger.Errorf("JSON decoding error: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := s.forwarders.RemoveForwarder(forwarder.Domain); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// recordToService fills the structured fields of the types with a dedicated
+// builder, every other type keeps its rdata in presentation format.
+func recordToService(rr dns.RR) utils.Service {
+	hdr := rr.Header()
+	service := utils.Service{
+		RecordType: dns.TypeToString[hdr.Rrtype],
+		TTL:        int(hdr.Ttl),
+		Aliases:    strings.ToLower(hdr.Name),
+	}
+	switch v := rr.(type) {
+	case *dns.A:
+		service.Value = v.A.String()
+	case *dns.AAAA:
+		service.Value = v.AAAA.String()
+	case *dns.CNAME:
+		service.Value = v.Target
+	case *dns.MX:
+		service.Preference = int(v.Preference)
+		service.Target = v.Mx
+		service.Value = v.Mx
+	case *dns.SRV:
+		service.Priority = int(v.Priority)
+		service.Weight = int(v.Weight)
+		service.Port = int(v.Port)
+		service.Target = v.Target
+		service.Value = v.Target
+	default:
+		service.Value = strings.TrimPrefix(rr.String(), hdr.String())
+	}
+	return service
+}
+
 func (s *HTTPServer) setTTL(w http.ResponseWriter, req *http.Request) {
 	var value int
 	if err := json.NewDecoder(req.Body).Decode(&value); err != nil {
@@ -138,14 +419,39 @@ func (s *HTTPServer) validation(service utils.Service) error {
 func validateDomainType(service utils.Service) error {
 	switch service.RecordType {
 	case "A":
-		if net.ParseIP(service.Value) == nil {
-			logger.Debugf("Property \"Value\" is NOT IP")
-			return errors.New("Property \"Value\" is NOT IP")
+		if ip := net.ParseIP(service.Value); ip == nil || ip.To4() == nil {
+			logger.Debugf("Property \"Value\" is NOT IPv4")
+			return errors.New("Property \"Value\" is NOT IPv4")
+		}
+	case "AAAA":
+		if ip := net.ParseIP(service.Value); ip == nil || ip.To4() != nil {
+			logger.Debugf("Property \"Value\" is NOT IPv6")
+			return errors.New("Property \"Value\" is NOT IPv6")
 		}
 	case "CNAME":
 		if !validateDomainName(service.Value) {
 			return errors.New("Property \"Value\" is wrong")
 		}
+	case "MX":
+		if err := validateTarget(service); err != nil {
+			return err
+		}
+		if !validateUint16(service.Preference) {
+			return errors.New("Property \"Preference\" is wrong")
+		}
+	case "SRV":
+		if err := validateTarget(service); err != nil {
+			return err
+		}
+		if !validateUint16(service.Priority) {
+			return errors.New("Property \"Priority\" is wrong")
+		}
+		if !validateUint16(service.Weight) {
+			return errors.New("Property \"Weight\" is wrong")
+		}
+		if !validateUint16(service.Port) {
+			return errors.New("Property \"Port\" is wrong")
+		}
 	default:
 		return errors.New("Property \"Record type\" is required or wrong")
 	}
@@ -168,6 +474,30 @@ func validateDomainName(domain string) bool {
 	return true
 }
 
+// validateTarget checks the host of MX and SRV records, which may be given
+// either as Target or as Value.
+func validateTarget(service utils.Service) error {
+	target := service.Target
+	if target == "" {
+		target = service.Value
+	}
+	if target == "" {
+		logger.Debugf("Property \"Target\" is required")
+		return errors.New("Property \"Target\" is required")
+	}
+	if service.Value != "" && service.Target != "" && dns.Fqdn(service.Value) != dns.Fqdn(service.Target) {
+		return errors.New("Property \"Value\" and \"Target\" differ")
+	}
+	if !validateDomainName(target) {
+		return errors.New("Property \"Target\" is wrong")
+	}
+	return nil
+}
+
+func validateUint16(value int) bool {
+	return value >= 0 && value <= 65535
+}
+
 /*
 func (s *HTTPServer) updateService(w http.ResponseWriter, req *http.Request) {
 	var result map[string]utils.Service
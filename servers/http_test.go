@@ -9,11 +9,17 @@
 package servers
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
 	"github.com/hawkingrei/g53/utils"
 	"github.com/hawkingrei/g53/version"
+	"github.com/miekg/dns"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"runtime"
 	"strings"
 	"testing"
@@ -62,7 +68,24 @@ func TestServiceRequests(t *testing.T) {
 		//{"PATCH", "/service", `{"originalValue":{"RecordType":"A","Value":"127.0.0.1","TTL":3600,"Aliases":"foo.duitang.com."},"modifyValue":{"RecordType":"A","Value":"127.0.0.10","TTL":3600,"Aliases":"foo.duitang.com."}}`, ``, 200},
 		{"GET", "/service", `{"RecordType":"A","Aliases":"foo.duitang.com."}`, `[{"RecordType":"A","Value":"127.0.0.1","TTL":3600,"Aliases":"foo.duitang.com."}]`, 200},
 		{"DELETE", "/service", `{"RecordType":"A","Value":"127.0.0.1","Aliases":"foo.duitang.com."}`, "", 200},
-		{"PUT", "/service", `{"RecordType":"MX","Value":"www.google.com.","TTL":3600,"Aliases":"www.aws.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"A","Value":"127.0.0.2","TTL":3600,"Aliases":"Web.duitang.com"}`, "", 200},
+		{"GET", "/service", `{"RecordType":"A","Aliases":"Web.duitang.com"}`, `[{"RecordType":"A","Value":"127.0.0.2","TTL":3600,"Aliases":"web.duitang.com."}]`, 200},
+		{"DELETE", "/service", `{"RecordType":"A","Value":"127.0.0.2","Aliases":"Web.duitang.com"}`, "", 200},
+		{"PUT", "/service", `{"RecordType":"TXT","Value":"www.google.com.","TTL":3600,"Aliases":"www.aws.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"MX","Value":"www.google.com.","TTL":3600,"Aliases":"www.aws.com."}`, "", 200},
+		{"PUT", "/service", `{"RecordType":"MX","TTL":3600,"Aliases":"mail.aws.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"MX","Preference":70000,"Target":"mx.aws.com.","TTL":3600,"Aliases":"mail.aws.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"MX","Preference":10,"Target":"mx.aws.com.","TTL":3600,"Aliases":"mail.aws.com."}`, "", 200},
+		{"GET", "/service", `{"RecordType":"MX","Aliases":"mail.aws.com."}`, `[{"RecordType":"MX","Value":"mx.aws.com.","TTL":3600,"Aliases":"mail.aws.com.","Preference":10,"Target":"mx.aws.com."}]`, 200},
+		{"DELETE", "/service", `{"RecordType":"MX","Target":"mx.aws.com.","Aliases":"mail.aws.com."}`, "", 200},
+		{"GET", "/service", `{"RecordType":"MX","Aliases":"mail.aws.com."}`, "", 404},
+		{"PUT", "/service", `{"RecordType":"SRV","Priority":10,"Weight":5,"Port":-1,"Target":"sip.aws.com.","TTL":3600,"Aliases":"_sip._udp.aws.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"SRV","Priority":10,"Weight":5,"Port":5060,"Target":"sip.aws.com.","TTL":3600,"Aliases":"_sip._udp.aws.com."}`, "", 200},
+		{"PUT", "/service", `{"RecordType":"A","Value":"fd00::1","TTL":3600,"Aliases":"v6.duitang.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"AAAA","Value":"127.0.0.1","TTL":3600,"Aliases":"v6.duitang.com."}`, "", 500},
+		{"PUT", "/service", `{"RecordType":"AAAA","Value":"fd00::1","TTL":3600,"Aliases":"v6.duitang.com."}`, "", 200},
+		{"PUT", "/service", `{"RecordType":"AAAA","Value":"fd00::1","TTL":3600,"Aliases":"v6.duitang.com."}`, "", 200},
+		{"PUT", "/service", `{"RecordType":"CNAME","Value":"www.google.com","TTL":3600,"Aliases":"v6.duitang.com."}`, "", 400},
 		//{"PUT", "/service", `{"RecordType":"CNAME","Value":"10.0.0.0","TTL":3600,"Aliases":"www.aws.com"}`, "", 500},
 		{"PUT", "/service", `{"RecordType":"CNAME","Value":"www.google.com","TTL":3600,"Aliases":"www.aws.com"}`, "", 200},
 		//{"PUT", "/service", `{"RecordType":"CNAME","Value":"www.baidu.com.","TTL":3600,"Aliases":"www.aws.com"}`, "", 500},
@@ -82,6 +105,37 @@ func TestServiceRequests(t *testing.T) {
 		//{"PUT", "/services", `{"RecordType":"CNAME","Value":"www.google.com","TTL":3600,"Aliases":"boo.duitang.com."}`, "", 200},
 		//{"DELETE", "/services/foo.duitang.com.", ``, "", 200},
 		//{"DELETE", "/services/foo", ``, "", 400},
+		{"PUT", "/record", `api 300 IN TXT "v=1"`, "", 200},
+		{"GET", "/service", `{"RecordType":"TXT","Aliases":"api.suphawking.com."}`, `[{"RecordType":"TXT","Value":"\"v=1\"","TTL":300,"Aliases":"api.suphawking.com."}]`, 200},
+		{"PUT", "/record", `mail 300 IN MX 10 mx.suphawking.com.`, "", 200},
+		{"GET", "/service", `{"RecordType":"MX","Aliases":"mail.suphawking.com."}`, `[{"RecordType":"MX","Value":"mx.suphawking.com.","TTL":300,"Aliases":"mail.suphawking.com.","Preference":10,"Target":"mx.suphawking.com."}]`, 200},
+		{"PUT", "/record", `api.example.com. 300 IN TXT "v=1"`, "", 500},
+		{"PUT", "/record", `web 300 IN A 10.0.0.5`, "", 200},
+		{"PUT", "/record", `web 300 IN CNAME api.suphawking.com.`, "", 400},
+		{"PUT", "/record", `api 300 IN TXT`, "", 500},
+		{"PUT", "/record", ``, "", 500},
+		{"DELETE", "/record", `api 300 IN TXT "v=2"`, "", 400},
+		{"DELETE", "/record", `api 300 IN TXT "v=1"`, "", 200},
+		{"GET", "/service", `{"RecordType":"TXT","Aliases":"api.suphawking.com."}`, "", 404},
+		{"PUT", "/service", `{"RecordType":"A","Value":"10.0.0.1","TTL":3600,"Aliases":"*.preview.duitang.com"}`, "", 200},
+		{"GET", "/service", `{"RecordType":"A","Aliases":"*.preview.duitang.com."}`, `[{"RecordType":"A","Value":"10.0.0.1","TTL":3600,"Aliases":"*.preview.duitang.com."}]`, 200},
+		{"PUT", "/zone", `{"Name":"dev.example.com","Ttl":60}`, "", 200},
+		{"PUT", "/zone", `{"Ttl":60}`, "", 500},
+		{"PUT", "/zone", `{"Name":`, "", 500},
+		{"PUT", "/record", `api.dev.example.com. 300 IN TXT "v=1"`, "", 200},
+		{"DELETE", "/zone", `{"Name":"nope.example.com"}`, "", 400},
+		{"DELETE", "/zone", `{"Name":"dev.example.com."}`, "", 200},
+		{"PUT", "/record", `web.dev.example.com. 300 IN TXT "v=1"`, "", 500},
+		{"PUT", "/forwarder", `{"Domain":"Consul","Nameservers":["127.0.0.1:8600"]}`, "", 200},
+		{"PUT", "/forwarder", `{"Domain":"corp.example.com.","Nameservers":["10.0.0.53","10.0.0.54:53"]}`, "", 200},
+		{"PUT", "/forwarder", `{"Domain":"corp.example.com.","Nameservers":["ns.example.com"]}`, "", 500},
+		{"PUT", "/forwarder", `{"Domain":"corp.example.com."}`, "", 500},
+		{"GET", "/forwarders", "", `[{"Domain":"consul.","Nameservers":["127.0.0.1:8600"]},{"Domain":"corp.example.com.","Nameservers":["10.0.0.53:53","10.0.0.54:53"]}]`, 200},
+		{"DELETE", "/forwarder", `{"Domain":"nope.example.com"}`, "", 400},
+		{"DELETE", "/forwarder", `{"Domain":"consul"}`, "", 200},
+		{"GET", "/forwarders", "", `[{"Domain":"corp.example.com.","Nameservers":["10.0.0.53:53","10.0.0.54:53"]}]`, 200},
+		{"GET", "/upstreams", "", "[]", 200},
+		{"GET", "/stats", "", `{"Forwarded":0,"Coalesced":0,"Stale":0,"Prefetched":0,"CacheEntries":0,"CacheBytes":0,"CacheEvictions":0,"CacheExpired":0,"CacheExpiredBytes":0}`, 200},
 		{"PUT", "/set/ttl", `AB`, "", 500},
 	}
 
@@ -133,3 +187,183 @@ func TestServiceRequests(t *testing.T) {
 		t.Error("TTL not updated. Expected: 12 Got:", config.Ttl)
 	}
 }
+
+func TestDNSOverHTTPS(t *testing.T) {
+	const TestAddr = "127.0.0.1:9982"
+	const TestHTTPSAddr = "127.0.0.1:9983"
+
+	dir, _ := ioutil.TempDir("", "g53")
+	defer os.RemoveAll(dir)
+	cert, key, x509Cert := writeCert(t, dir, "g53.test")
+
+	config := utils.NewConfig()
+	config.HttpAddr = TestAddr
+	config.HttpsAddr = TestHTTPSAddr
+	config.TlsCert = cert
+	config.TlsKey = key
+
+	dnsServer := NewDNSServer(config)
+	server := NewHTTPServer(config, dnsServer)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	dnsServer.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "127.0.0.1", Aliases: "a.suphawking.com"})
+	dnsServer.AddService(utils.Service{RecordType: "A", TTL: 60, Value: "127.0.0.2", Aliases: "a.suphawking.com"})
+
+	query := func(name string) []byte {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Id = 0
+		buf, _ := m.Pack()
+		return buf
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(x509Cert)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{ServerName: "g53.test", RootCAs: roots}}}
+
+	var tests = []struct {
+		method, url, contentType string
+		body                     []byte
+		status                   int
+		rcode, answers           int
+		cacheControl             string
+	}{
+		{"GET", "http://" + TestAddr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query("a.suphawking.com.")), "", nil, 200, dns.RcodeSuccess, 2, "max-age=60"},
+		{"POST", "http://" + TestAddr + "/dns-query", "application/dns-message", query("a.suphawking.com."), 200, dns.RcodeSuccess, 2, "max-age=60"},
+		{"POST", "https://" + TestHTTPSAddr + "/dns-query", "application/dns-message", query("a.suphawking.com."), 200, dns.RcodeSuccess, 2, "max-age=60"},
+		{"GET", "http://" + TestAddr + "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(query("b.suphawking.com.")), "", nil, 200, dns.RcodeNameError, 0, "max-age=0"},
+		{"GET", "http://" + TestAddr + "/dns-query?dns=%%%", "", nil, 400, 0, 0, ""},
+		{"GET", "http://" + TestAddr + "/dns-query", "", nil, 400, 0, 0, ""},
+		{"POST", "http://" + TestAddr + "/dns-query", "text/plain", query("a.suphawking.com."), 415, 0, 0, ""},
+		{"PUT", "https://" + TestHTTPSAddr + "/service", "application/json", []byte(`{"RecordType":"A","Value":"10.0.0.1","Aliases":"b.suphawking.com"}`), 404, 0, 0, ""},
+		{"GET", "https://" + TestHTTPSAddr + "/services", "", nil, 404, 0, 0, ""},
+	}
+	for _, input := range tests {
+		req, err := http.NewRequest(input.method, input.url, bytes.NewReader(input.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if input.contentType != "" {
+			req.Header.Set("Content-Type", input.contentType)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != input.status {
+			t.Error(input.url, "Expected status:", input.status, "Got:", resp.StatusCode)
+			continue
+		}
+		if input.status != 200 {
+			continue
+		}
+		if resp.Header.Get("Content-Type") != "application/dns-message" {
+			t.Error(input.url, "Unexpected Content-Type:", resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Cache-Control") != input.cacheControl {
+			t.Error(input.url, "Expected Cache-Control:", input.cacheControl, "Got:", resp.Header.Get("Cache-Control"))
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(body); err != nil {
+			t.Error(err)
+			continue
+		}
+		if m.Rcode != input.rcode || len(m.Answer) != input.answers {
+			t.Error(input.url, "Unexpected reply:", m)
+		}
+	}
+}
+
+func TestResolveExplain(t *testing.T) {
+	const TestAddr = "127.0.0.1:9984"
+	const UpstreamAddr = "127.0.0.1:9985"
+
+	stop := startFakeUpstream(UpstreamAddr, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	})
+	defer stop()
+
+	config := utils.NewConfig()
+	config.HttpAddr = TestAddr
+	config.Nameservers = []string{UpstreamAddr}
+
+	dnsServer := NewDNSServer(config)
+	server := NewHTTPServer(config, dnsServer)
+	go server.Start()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	dnsServer.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "127.0.0.1", Aliases: "a.suphawking.com"})
+	dnsServer.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "a.suphawking.com", Aliases: "b.suphawking.com"})
+	dnsServer.AddService(utils.Service{RecordType: "CNAME", TTL: 600, Value: "www.example.org", Aliases: "c.suphawking.com"})
+
+	var tests = []struct {
+		query   string
+		status  int
+		answers []string
+		sources []string
+	}{
+		{"name=a.suphawking.com&type=A", dns.RcodeSuccess, []string{"127.0.0.1"}, []string{"private"}},
+		{"name=b.suphawking.com", dns.RcodeSuccess, []string{"a.suphawking.com.", "127.0.0.1"}, []string{"private", "cname"}},
+		{"name=c.suphawking.com&type=1", dns.RcodeSuccess, []string{"www.example.org.", "192.0.2.1"}, []string{"private", "cname", "upstream"}},
+		{"name=d.suphawking.com", dns.RcodeNameError, []string{}, []string{"authoritative"}},
+		{"name=www.example.com", dns.RcodeSuccess, []string{"192.0.2.1"}, []string{"public-cache", "upstream"}},
+		{"name=www.example.com", dns.RcodeSuccess, []string{"192.0.2.1"}, []string{"public-cache"}},
+	}
+	for _, input := range tests {
+		resp, err := http.Get("http://" + TestAddr + "/resolve?" + input.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply struct {
+			Status int
+			Answer []struct {
+				Data string `json:"data"`
+			}
+			Explain struct {
+				Steps []struct{ Source, Detail, Duration string }
+			}
+		}
+		err = json.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if err != nil {
+			t.Error(input.query, err)
+			continue
+		}
+		answers := []string{}
+		for _, rr := range reply.Answer {
+			answers = append(answers, rr.Data)
+		}
+		sources := []string{}
+		for _, step := range reply.Explain.Steps {
+			sources = append(sources, step.Source)
+		}
+		if reply.Status != input.status || strings.Join(answers, " ") != strings.Join(input.answers, " ") {
+			t.Error(input.query, "Unexpected reply:", reply)
+		}
+		if strings.Join(sources, " ") != strings.Join(input.sources, " ") {
+			t.Error(input.query, "Expected steps:", input.sources, "Got:", reply.Explain.Steps)
+		}
+	}
+
+	for _, query := range []string{"", "name=a.suphawking.com&type=FOO"} {
+		resp, err := http.Get("http://" + TestAddr + "/resolve?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Error(query, "Expected status 400, got", resp.StatusCode)
+		}
+	}
+}
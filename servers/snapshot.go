@@ -0,0 +1,94 @@
+package servers
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// loadCache warms the public cache up with the answers of the cache file
+// which didn't expire yet.
+func (s *DNSServer) loadCache() {
+	if s.config.CacheFile == "" {
+		return
+	}
+	f, err := os.Open(s.config.CacheFile)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.Errorf("Unable to load the cache: %s", err)
+		return
+	}
+	defer f.Close()
+	loaded, err := s.publicDns.Load(f)
+	if err != nil {
+		logger.Errorf("Unable to load the cache from '%s': %s", s.config.CacheFile, err)
+	}
+	logger.Infof("Loaded %d cached answers from '%s'", loaded, s.config.CacheFile)
+}
+
+// saveCache writes the public cache into the cache file, through a
+// temporary file so that the cache file is never left half written.
+func (s *DNSServer) saveCache() error {
+	if s.config.CacheFile == "" {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.config.CacheFile), ".g53-cache")
+	if err != nil {
+		return err
+	}
+	saved, err := s.publicDns.Save(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.config.CacheFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	logger.Debugf("Saved %d cached answers into '%s'", saved, s.config.CacheFile)
+	return nil
+}
+
+// startSaving saves the public cache every CacheSaveInterval until
+// stopSaving is called.
+func (s *DNSServer) startSaving() {
+	s.saveLock.Lock()
+	defer s.saveLock.Unlock()
+	if s.config.CacheFile == "" || s.config.CacheSaveInterval <= 0 || s.stopSave != nil {
+		return
+	}
+	stop := make(chan struct{})
+	s.stopSave = stop
+	go func() {
+		ticker := time.NewTicker(s.config.CacheSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.saveCache(); err != nil {
+					logger.Errorf("Unable to save the cache: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopSaving stops the periodic saves and saves the public cache a last
+// time.
+func (s *DNSServer) stopSaving() {
+	s.saveLock.Lock()
+	if s.stopSave != nil {
+		close(s.stopSave)
+		s.stopSave = nil
+	}
+	s.saveLock.Unlock()
+	if err := s.saveCache(); err != nil {
+		logger.Errorf("Unable to save the cache: %s", err)
+	}
+}
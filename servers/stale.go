@@ -0,0 +1,79 @@
+package servers
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hawkingrei/g53/servers/dnsutils"
+	"github.com/miekg/dns"
+)
+
+// exchangeResult is the outcome of an upstream exchange run in background
+type exchangeResult struct {
+	msg *dns.Msg
+	err error
+}
+
+// exchangeOrStale sends req, the upstream form of r, to the nameservers.
+// When serving stale data is enabled (RFC 8767), the expired answer of the
+// cache is returned if every nameserver fails, or if none answered within
+// StaleAnswerTimeout, in which case the cache is refreshed in background.
+// Without expired answer, the last SERVFAIL or REFUSED reply is passed on.
+func (s *DNSServer) exchangeOrStale(nameservers []string, r *dns.Msg, req *dns.Msg, tr *explainTrace) (*dns.Msg, error) {
+	if s.config.ServeStale <= 0 {
+		return failedReply(s.exchange(nameservers, req, tr))
+	}
+	// the exchange may outlive the request, it records into its own trace
+	sub := tr.child()
+	results := make(chan exchangeResult, 1)
+	go func() {
+		in, err := s.exchange(nameservers, req, sub)
+		results <- exchangeResult{in, err}
+	}()
+	var timeout <-chan time.Time
+	if s.config.StaleAnswerTimeout > 0 {
+		timer := time.NewTimer(s.config.StaleAnswerTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case res := <-results:
+			tr.merge(sub)
+			if res.err == nil {
+				return res.msg, nil
+			}
+			if stale, err := s.queryStaleCache(r); err == nil {
+				logger.Noticef("Serving stale answer for '%s': %s", r.Question[0].Name, res.err)
+				tr.add("stale", "every upstream failed, serving the expired answer")
+				return stale, nil
+			}
+			return failedReply(res.msg, res.err)
+		case <-timeout:
+			timeout = nil
+			if stale, err := s.queryStaleCache(r); err == nil {
+				logger.Noticef("Serving stale answer for '%s' while refreshing it", r.Question[0].Name)
+				tr.add("stale", "no upstream answer after %s, serving the expired answer while refreshing it", s.config.StaleAnswerTimeout)
+				return stale, nil
+			}
+		}
+	}
+}
+
+// failedReply turns the failing reply in the nameservers returned with err
+// into the answer, if there is one.
+func failedReply(in *dns.Msg, err error) (*dns.Msg, error) {
+	if err != nil && in != nil {
+		return in, nil
+	}
+	return in, err
+}
+
+// queryStaleCache answers r with expired records of the public cache
+func (s *DNSServer) queryStaleCache(r *dns.Msg) (*dns.Msg, error) {
+	m, err := dnsutils.QueryStaleCache(s.publicDns, r, s.config.ServeStale, uint32(s.config.StaleTTL/time.Second))
+	if err == nil {
+		atomic.AddUint64(&s.staleAnswers, 1)
+	}
+	return m, err
+}
@@ -1,6 +1,10 @@
 package servers
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/op/go-logging"
 
 	"github.com/hawkingrei/g53/utils"
@@ -35,7 +39,19 @@ func StartServer(rawParams []string) {
 		}
 	}()
 
+	// the DNS server saves its cache when it is stopped by a signal
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logger.Infof("Received %s, stopping the DNS server", sig)
+		dnsServer.Stop()
+		close(stopped)
+	}()
+
 	if err := dnsServer.Start(); err != nil {
 		logger.Fatalf("Error: '%s'", err)
 	}
+	<-stopped
 }
@@ -0,0 +1,139 @@
+package servers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block length responses over TLS are padded to,
+// as recommended by RFC 8467.
+const paddingBlockSize = 468
+
+// certReloader loads a certificate and reloads it once its files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.GetCertificate(nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as
+// tls.Config.GetCertificate. A certificate which fails to load is logged
+// and the previous one is kept.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	modTime, err := c.lastModified()
+	if err != nil && c.cert == nil {
+		return nil, err
+	}
+	if err == nil && modTime.After(c.modTime) {
+		cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+		if err != nil {
+			if c.cert == nil {
+				return nil, err
+			}
+			logger.Errorf("Unable to reload TLS certificate: %s", err)
+		} else {
+			logger.Infof("Loaded TLS certificate '%s'", c.certFile)
+			c.cert = &cert
+			c.modTime = modTime
+		}
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) lastModified() (time.Time, error) {
+	var modTime time.Time
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return modTime, err
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+// newTLSConfig builds the configuration of the DNS over TLS listener.
+// Client certificates are checked against TlsCaCert when it is set, and
+// required when TlsVerify is set.
+func newTLSConfig(c *utils.Config) (*tls.Config, error) {
+	if c.TlsCert == "" || c.TlsKey == "" {
+		return nil, errors.New("DNS over TLS requires a certificate and a key")
+	}
+	reloader, err := newCertReloader(c.TlsCert, c.TlsKey)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if c.TlsCaCert != "" {
+		ca, err := ioutil.ReadFile(c.TlsCaCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("No CA certificate found in " + c.TlsCaCert)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if c.TlsVerify {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if c.TlsVerify {
+		return nil, errors.New("Verifying clients requires a CA certificate")
+	}
+	return config, nil
+}
+
+// isEncrypted tells whether w replies over TLS
+func isEncrypted(w dns.ResponseWriter) bool {
+	if stater, ok := w.(dns.ConnectionStater); ok {
+		return stater.ConnectionState() != nil
+	}
+	return false
+}
+
+// padMsg pads m to a multiple of paddingBlockSize when the query was padded
+// itself (RFC 7830 section 4). m must already carry its OPT record.
+func padMsg(r *dns.Msg, m *dns.Msg) {
+	query := r.IsEdns0()
+	opt := m.IsEdns0()
+	if query == nil || opt == nil {
+		return
+	}
+	for _, option := range query.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			continue
+		}
+		m.Compress = true
+		// 4 bytes are used by the code and length of the option
+		length := m.Len() + 4
+		padding := (paddingBlockSize - length%paddingBlockSize) % paddingBlockSize
+		opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+		return
+	}
+}
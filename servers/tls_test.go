@@ -0,0 +1,176 @@
+package servers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
+)
+
+// writeCert writes a self-signed certificate for commonName and its key to dir
+func writeCert(t *testing.T, dir string, commonName string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, commonName+".crt")
+	keyFile := filepath.Join(dir, commonName+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile, cert
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "g53")
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile, first := writeCert(t, dir, "first")
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newCert, newKey, second := writeCert(t, dir, "second")
+	os.Rename(newCert, certFile)
+	os.Rename(newKey, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Equal(second) || !second.Equal(mustParse(t, cert)) {
+		t.Error("Expected the certificate to be reloaded")
+	}
+
+	// a broken file keeps the previous certificate
+	ioutil.WriteFile(certFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil || !second.Equal(mustParse(t, cert)) {
+		t.Error("Expected the previous certificate to be kept", err)
+	}
+}
+
+func mustParse(t *testing.T, cert *tls.Certificate) *x509.Certificate {
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestDNSOverTLS(t *testing.T) {
+	const TestAddr = "127.0.0.1:9966"
+	const TestTLSAddr = "127.0.0.1:9967"
+
+	dir, _ := ioutil.TempDir("", "g53")
+	defer os.RemoveAll(dir)
+	serverCert, serverKey, serverX509 := writeCert(t, dir, "g53.test")
+	clientCert, clientKey, _ := writeCert(t, dir, "client.test")
+
+	config := utils.NewConfig()
+	config.DnsAddr = TestAddr
+	config.TlsAddr = TestTLSAddr
+	config.TlsCert = serverCert
+	config.TlsKey = serverKey
+	config.TlsCaCert = clientCert
+	config.TlsVerify = true
+
+	server := NewDNSServer(config)
+	go server.Start()
+	defer func() {
+		server.Stop()
+		time.Sleep(250 * time.Millisecond)
+	}()
+
+	// Allow some time for server to start
+	time.Sleep(250 * time.Millisecond)
+
+	server.AddService(utils.Service{RecordType: "A", TTL: 600, Value: "127.0.0.1", Aliases: "a.duitang.net"})
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverX509)
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &dns.Client{Net: "tcp-tls", Timeout: 5 * time.Second, TLSConfig: &tls.Config{
+		ServerName:   "g53.test",
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{pair},
+	}}
+
+	m := new(dns.Msg)
+	m.SetQuestion("a.duitang.net.", dns.TypeA)
+	m.SetEdns0(ednsBufferSize, false)
+	opt := m.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+
+	in, _, err := c.Exchange(m, TestTLSAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	if len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Error("Expected the private record over TLS, got:", in.Answer)
+	}
+	in.Compress = true
+	packed, _ := in.Pack()
+	if len(packed)%paddingBlockSize != 0 {
+		t.Error("Expected the reply to be padded, got length", len(packed))
+	}
+
+	// plain TCP replies are never padded
+	c.Net = "tcp"
+	in, _, err = c.Exchange(m, TestAddr)
+	if err != nil {
+		t.Fatal("Error response from the server", err)
+	}
+	for _, option := range in.IsEdns0().Option {
+		if option.Option() == dns.EDNS0PADDING {
+			t.Error("Expected no padding over plain TCP")
+		}
+	}
+
+	// clients without certificate are rejected
+	c.Net = "tcp-tls"
+	c.TLSConfig.Certificates = nil
+	if _, _, err = c.Exchange(m, TestTLSAddr); err == nil {
+		t.Error("Expected clients without certificate to be rejected")
+	}
+}
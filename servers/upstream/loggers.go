@@ -0,0 +1,7 @@
+package upstream
+
+import (
+	"github.com/op/go-logging"
+)
+
+var logger = logging.MustGetLogger("G53.upstream")
@@ -0,0 +1,288 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// udpSize is the buffer size advertised by the UDP transport
+	udpSize = 4096
+	// maxIdleConns bounds the connections kept open to a nameserver
+	maxIdleConns = 4
+)
+
+// Address is a parsed nameserver entry, like `tls://9.9.9.9:853#dns.quad9.net`
+type Address struct {
+	Net        string
+	Addr       string
+	ServerName string
+	URL        string
+	Timeout    time.Duration
+}
+
+// ParseAddress parses a nameserver entry. Plain `host:port` entries and
+// `udp://` use UDP, the other schemes are `tcp://`, `tls://` with an
+// optional `#servername` and `https://` with the URL of the DoH endpoint.
+// A `timeout` query parameter overrides the default timeout.
+func ParseAddress(value string) (Address, error) {
+	if !strings.Contains(value, "://") {
+		value = "udp://" + value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return Address{}, err
+	}
+	address := Address{Net: u.Scheme, Addr: u.Host}
+	if timeout := u.Query().Get("timeout"); timeout != "" {
+		if address.Timeout, err = time.ParseDuration(timeout); err != nil {
+			return Address{}, err
+		}
+		q := u.Query()
+		q.Del("timeout")
+		u.RawQuery = q.Encode()
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		address.Addr = hostPort(u.Host, "53")
+	case "tls":
+		address.Addr = hostPort(u.Host, "853")
+		address.ServerName = u.Fragment
+		if address.ServerName == "" {
+			address.ServerName = u.Hostname()
+		}
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		u.Fragment = ""
+		address.URL = u.String()
+	default:
+		return Address{}, fmt.Errorf("Unknown scheme '%s' in nameserver '%s'", u.Scheme, value)
+	}
+	if u.Hostname() == "" {
+		return Address{}, fmt.Errorf("Nameserver '%s' has no host", value)
+	}
+	return address, nil
+}
+
+func hostPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// transport sends queries to one nameserver
+type transport interface {
+	exchange(m *dns.Msg) (*dns.Msg, error)
+}
+
+// Client sends queries over the transport of each nameserver entry, it
+// keeps connections to TCP, TLS and HTTPS nameservers open for further
+// queries. TLSConfig, when set, is the base configuration of the TLS and
+// HTTPS transports.
+type Client struct {
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+
+	lock       sync.Mutex
+	transports map[string]transport
+}
+
+// NewClient creates a client with the default timeout of the nameservers
+func NewClient(timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &Client{Timeout: timeout, transports: make(map[string]transport)}
+}
+
+// Exchange sends m to the nameserver entry address
+func (c *Client) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	t, err := c.transport(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	in, err := t.exchange(m)
+	return in, time.Since(start), err
+}
+
+func (c *Client) transport(value string) (transport, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if t, ok := c.transports[value]; ok {
+		return t, nil
+	}
+	address, err := ParseAddress(value)
+	if err != nil {
+		return nil, err
+	}
+	if address.Timeout == 0 {
+		address.Timeout = c.Timeout
+	}
+	var t transport
+	switch address.Net {
+	case "udp":
+		t = &udpTransport{
+			client: &dns.Client{Net: "udp", UDPSize: udpSize, Timeout: address.Timeout},
+			addr:   address.Addr,
+			tcp:    newStreamTransport(address, nil),
+		}
+	case "tcp":
+		t = newStreamTransport(address, nil)
+	case "tls":
+		config := c.tlsConfig()
+		config.ServerName = address.ServerName
+		t = newStreamTransport(address, config)
+	case "https":
+		t = &httpsTransport{
+			url: address.URL,
+			client: &http.Client{
+				Timeout:   address.Timeout,
+				Transport: &http.Transport{TLSClientConfig: c.tlsConfig(), MaxIdleConnsPerHost: maxIdleConns},
+			},
+		}
+	}
+	c.transports[value] = t
+	return t, nil
+}
+
+func (c *Client) tlsConfig() *tls.Config {
+	if c.TLSConfig != nil {
+		return c.TLSConfig.Clone()
+	}
+	return &tls.Config{}
+}
+
+// udpTransport retries truncated answers over TCP
+type udpTransport struct {
+	client *dns.Client
+	addr   string
+	tcp    *streamTransport
+}
+
+func (t *udpTransport) exchange(m *dns.Msg) (*dns.Msg, error) {
+	in, _, err := t.client.Exchange(m, t.addr)
+	if err == nil && in.Truncated {
+		logger.Debugf("Answer of %s is truncated, retrying over TCP", t.addr)
+		return t.tcp.exchange(m)
+	}
+	return in, err
+}
+
+// streamTransport keeps idle TCP or TLS connections for further queries
+type streamTransport struct {
+	client *dns.Client
+	addr   string
+	lock   sync.Mutex
+	idle   []*dns.Conn
+}
+
+func newStreamTransport(address Address, config *tls.Config) *streamTransport {
+	client := &dns.Client{Net: "tcp", Timeout: address.Timeout}
+	if config != nil {
+		client.Net = "tcp-tls"
+		client.TLSConfig = config
+	}
+	return &streamTransport{client: client, addr: address.Addr}
+}
+
+func (t *streamTransport) exchange(m *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+	in, _, err := t.client.ExchangeWithConn(m, conn)
+	if err != nil && reused {
+		// the nameserver may have closed an idle connection
+		conn.Close()
+		if conn, err = t.client.Dial(t.addr); err != nil {
+			return nil, err
+		}
+		in, _, err = t.client.ExchangeWithConn(m, conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.put(conn)
+	return in, nil
+}
+
+func (t *streamTransport) get() (*dns.Conn, bool, error) {
+	t.lock.Lock()
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.lock.Unlock()
+		return conn, true, nil
+	}
+	t.lock.Unlock()
+	conn, err := t.client.Dial(t.addr)
+	return conn, false, err
+}
+
+func (t *streamTransport) put(conn *dns.Conn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+// httpsTransport sends queries to a DNS over HTTPS endpoint (RFC 8484),
+// net/http keeps the connections open.
+type httpsTransport struct {
+	url    string
+	client *http.Client
+}
+
+func (t *httpsTransport) exchange(m *dns.Msg) (*dns.Msg, error) {
+	// the ID is 0 so that the answers can be cached by HTTP caches
+	query := m.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("DNS over HTTPS request failed: " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	in := new(dns.Msg)
+	if err := in.Unpack(body); err != nil {
+		return nil, err
+	}
+	in.Id = m.Id
+	return in, nil
+}
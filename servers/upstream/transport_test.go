@@ -0,0 +1,163 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseAddress(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected Address
+	}{
+		{"8.8.8.8:53", Address{Net: "udp", Addr: "8.8.8.8:53"}},
+		{"udp://8.8.8.8", Address{Net: "udp", Addr: "8.8.8.8:53"}},
+		{"tcp://[2001:4860:4860::8888]", Address{Net: "tcp", Addr: "[2001:4860:4860::8888]:53"}},
+		{"tls://9.9.9.9#dns.quad9.net", Address{Net: "tls", Addr: "9.9.9.9:853", ServerName: "dns.quad9.net"}},
+		{"tls://dns.quad9.net:8853?timeout=2s", Address{Net: "tls", Addr: "dns.quad9.net:8853", ServerName: "dns.quad9.net", Timeout: 2 * time.Second}},
+		{"https://dns.google", Address{Net: "https", Addr: "dns.google", URL: "https://dns.google/dns-query"}},
+		{"https://dns.google/resolve?timeout=1s", Address{Net: "https", Addr: "dns.google", URL: "https://dns.google/resolve", Timeout: time.Second}},
+	}
+	for _, input := range tests {
+		actual, err := ParseAddress(input.input)
+		if err != nil || !reflect.DeepEqual(actual, input.expected) {
+			t.Error(input.input, "Expected:", input.expected, "Got:", actual, err)
+		}
+	}
+	for _, input := range []string{"quic://8.8.8.8", "tcp://", "udp://8.8.8.8?timeout=soon"} {
+		if _, err := ParseAddress(input); err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
+
+// countingListener counts the connections it accepts
+type countingListener struct {
+	net.Listener
+	accepted int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func answer(truncate bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if truncate {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// serve starts a DNS server on listener, or on packetConn for UDP
+func serve(t *testing.T, server *dns.Server) func() {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	go server.ActivateAndServe()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("DNS server didn't start")
+	}
+	return func() { server.Shutdown() }
+}
+
+func TestUDPTruncationAndTCPReuse(t *testing.T) {
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := packetConn.LocalAddr().String()
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: tcpListener}
+	defer serve(t, &dns.Server{PacketConn: packetConn, Handler: answer(true)})()
+	defer serve(t, &dns.Server{Listener: listener, Handler: answer(false)})()
+
+	client := NewClient(time.Second)
+	for i := 0; i < 3; i++ {
+		in, _, err := client.Exchange(query(), addr)
+		if err != nil || in.Truncated || len(in.Answer) != 1 {
+			t.Fatal("Expected the truncated answer to be retried over TCP, got:", in, err)
+		}
+	}
+	if accepted := atomic.LoadInt32(&listener.accepted); accepted != 1 {
+		t.Error("Expected the TCP connection to be reused, got", accepted, "connections")
+	}
+}
+
+func TestTLSAndHTTPS(t *testing.T) {
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		buf, _ := ioutil.ReadAll(req.Body)
+		r := new(dns.Msg)
+		if req.Header.Get("Content-Type") != "application/dns-message" || r.Unpack(buf) != nil || r.Id != 0 {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.2")
+		m.Answer = append(m.Answer, rr)
+		out, _ := m.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(out)
+	}))
+	defer doh.Close()
+
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: doh.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serve(t, &dns.Server{Listener: tlsListener, Net: "tcp-tls", Handler: answer(false)})()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(doh.Certificate())
+	client := NewClient(time.Second)
+	client.TLSConfig = &tls.Config{RootCAs: roots}
+
+	var tests = []struct {
+		address, expected string
+	}{
+		{"tls://" + tlsListener.Addr().String(), "192.0.2.1"},
+		{"https://" + doh.Listener.Addr().String() + "/dns-query", "192.0.2.2"},
+	}
+	for _, input := range tests {
+		m := query()
+		m.Id = 1234
+		in, _, err := client.Exchange(m, input.address)
+		if err != nil {
+			t.Error(input.address, err)
+			continue
+		}
+		if in.Id != 1234 || len(in.Answer) != 1 || in.Answer[0].(*dns.A).A.String() != input.expected {
+			t.Error(input.address, "Unexpected answer:", in)
+		}
+	}
+
+	// the certificate must match the server name
+	if _, _, err := client.Exchange(query(), "tls://"+tlsListener.Addr().String()+"#other.invalid"); err == nil {
+		t.Error("Expected a certificate error")
+	}
+}
@@ -0,0 +1,345 @@
+// Package upstream selects the nameservers queries are forwarded to and
+// tracks their health.
+package upstream
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy chooses the order nameservers are tried in
+type Strategy string
+
+const (
+	// Sequential tries the nameservers in the configured order
+	Sequential Strategy = "sequential"
+	// RoundRobin starts with the next nameserver on every query
+	RoundRobin Strategy = "round-robin"
+	// LowestLatency tries the nameservers with the lowest RTT first
+	LowestLatency Strategy = "lowest-latency"
+	// Race sends the query to the first nameservers at once and keeps the
+	// first answer
+	Race Strategy = "race"
+)
+
+// Strategies lists the known strategies
+var Strategies = []string{string(Sequential), string(RoundRobin), string(LowestLatency), string(Race)}
+
+// errAllFailed comes with the last SERVFAIL or REFUSED reply
+var errAllFailed = errors.New("Every nameserver failed")
+
+const (
+	// rttWeight is the weight of a new sample in the RTT moving average
+	rttWeight = 0.3
+)
+
+// Exchanger sends a query to a nameserver, *dns.Client is one
+type Exchanger interface {
+	Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error)
+}
+
+// Attempt is the outcome of sending a query to one nameserver
+type Attempt struct {
+	Addr string
+	RTT  time.Duration
+	Err  error
+}
+
+// Status is the health of a nameserver
+type Status struct {
+	Addr                string
+	Healthy             bool
+	ConsecutiveFailures int
+	RTT                 string
+	Queries             uint64
+	Failures            uint64
+	EjectedUntil        *time.Time `json:",omitempty"`
+}
+
+// upstream holds the health of a nameserver
+type upstream struct {
+	addr         string
+	failures     int
+	rtt          time.Duration
+	queries      uint64
+	errors       uint64
+	ejectedUntil time.Time
+}
+
+func (u *upstream) ejected(now time.Time) bool {
+	return now.Before(u.ejectedUntil)
+}
+
+// Pool forwards queries to nameservers following a strategy. Nameservers
+// failing MaxFails times in a row are ejected for EjectDuration, unless a
+// probe finds them answering again earlier.
+type Pool struct {
+	Strategy      Strategy
+	RaceCount     int
+	MaxFails      int
+	EjectDuration time.Duration
+	ProbeInterval time.Duration
+
+	lock      sync.Mutex
+	client    Exchanger
+	upstreams map[string]*upstream
+	next      int
+	stop      chan struct{}
+}
+
+// NewPool creates a pool sending queries with client
+func NewPool(client Exchanger, strategy Strategy, raceCount int) *Pool {
+	if raceCount < 1 {
+		raceCount = 1
+	}
+	return &Pool{
+		Strategy:      strategy,
+		RaceCount:     raceCount,
+		MaxFails:      3,
+		EjectDuration: 30 * time.Second,
+		ProbeInterval: 5 * time.Second,
+		client:        client,
+		upstreams:     make(map[string]*upstream),
+	}
+}
+
+// Exchange sends r to the nameservers until one of them answers, it
+// returns the answer and every attempt made. SERVFAIL and REFUSED replies
+// are failed attempts, when every nameserver failed the last of them is
+// returned along with the error.
+func (p *Pool) Exchange(r *dns.Msg, nameservers []string) (*dns.Msg, []Attempt, error) {
+	if len(nameservers) == 0 {
+		return nil, nil, errors.New("No nameserver to forward to")
+	}
+	order := p.order(nameservers)
+	attempts := []Attempt{}
+	// last is the last SERVFAIL or REFUSED reply
+	var last *dns.Msg
+	if p.Strategy == Race && p.RaceCount > 1 && len(order) > 1 {
+		n := p.RaceCount
+		if n > len(order) {
+			n = len(order)
+		}
+		in, raced, ok := p.race(r, order[:n])
+		attempts = append(attempts, raced...)
+		if ok {
+			return in, attempts, nil
+		}
+		last = in
+		order = order[n:]
+	}
+	var err error
+	for _, addr := range order {
+		in, attempt := p.exchange(r, addr)
+		attempts = append(attempts, attempt)
+		if attempt.Err == nil {
+			return in, attempts, nil
+		}
+		if in != nil {
+			last = in
+		}
+		err = attempt.Err
+	}
+	if last != nil {
+		return last, attempts, errAllFailed
+	}
+	if err == nil {
+		err = errors.New("No nameserver answered")
+	}
+	return nil, attempts, err
+}
+
+// race sends r to every nameserver at once and returns the first answer,
+// or the last SERVFAIL or REFUSED reply when it reports no answer.
+func (p *Pool) race(r *dns.Msg, nameservers []string) (*dns.Msg, []Attempt, bool) {
+	type result struct {
+		in      *dns.Msg
+		attempt Attempt
+	}
+	results := make(chan result, len(nameservers))
+	for _, addr := range nameservers {
+		go func(addr string) {
+			in, attempt := p.exchange(r.Copy(), addr)
+			results <- result{in, attempt}
+		}(addr)
+	}
+	attempts := []Attempt{}
+	var last *dns.Msg
+	for range nameservers {
+		res := <-results
+		attempts = append(attempts, res.attempt)
+		if res.attempt.Err == nil {
+			return res.in, attempts, true
+		}
+		if res.in != nil {
+			last = res.in
+		}
+	}
+	return last, attempts, false
+}
+
+// exchange sends r to addr, a SERVFAIL or REFUSED reply is a failed attempt
+// like a transport error, but it is returned too.
+func (p *Pool) exchange(r *dns.Msg, addr string) (*dns.Msg, Attempt) {
+	start := time.Now()
+	in, _, err := p.client.Exchange(r, addr)
+	if err == nil && (in.Rcode == dns.RcodeServerFailure || in.Rcode == dns.RcodeRefused) {
+		err = errors.New("Nameserver answered " + dns.RcodeToString[in.Rcode])
+	}
+	attempt := Attempt{Addr: addr, RTT: time.Since(start), Err: err}
+	p.record(attempt)
+	return in, attempt
+}
+
+// record updates the health of a nameserver with the outcome of a query
+func (p *Pool) record(attempt Attempt) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	u := p.get(attempt.Addr)
+	u.queries++
+	if attempt.Err != nil {
+		u.errors++
+		u.failures++
+		if u.failures >= p.MaxFails {
+			if !u.ejected(time.Now()) {
+				logger.Warningf("Ejecting nameserver %s after %d failures: %s", u.addr, u.failures, attempt.Err)
+			}
+			u.ejectedUntil = time.Now().Add(p.EjectDuration)
+		}
+		return
+	}
+	if u.failures >= p.MaxFails {
+		logger.Noticef("Nameserver %s is answering again", u.addr)
+	}
+	u.failures = 0
+	u.ejectedUntil = time.Time{}
+	if u.rtt == 0 {
+		u.rtt = attempt.RTT
+	} else {
+		u.rtt = time.Duration(rttWeight*float64(attempt.RTT) + (1-rttWeight)*float64(u.rtt))
+	}
+}
+
+// get returns the health of a nameserver, p.lock must be held
+func (p *Pool) get(addr string) *upstream {
+	u, ok := p.upstreams[addr]
+	if !ok {
+		u = &upstream{addr: addr}
+		p.upstreams[addr] = u
+	}
+	return u
+}
+
+// order sorts the nameservers following the strategy, ejected nameservers
+// come last and are only tried when every other one failed.
+func (p *Pool) order(nameservers []string) []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	healthy := []string{}
+	ejected := []string{}
+	for _, addr := range nameservers {
+		if p.get(addr).ejected(now) {
+			ejected = append(ejected, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+	switch p.Strategy {
+	case RoundRobin:
+		if len(healthy) > 0 {
+			start := p.next % len(healthy)
+			p.next++
+			healthy = append(healthy[start:], healthy[:start]...)
+		}
+	case LowestLatency:
+		// nameservers without RTT yet are tried first to measure them
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return p.upstreams[healthy[i]].rtt < p.upstreams[healthy[j]].rtt
+		})
+	}
+	return append(healthy, ejected...)
+}
+
+// Status lists the health of the nameservers queried so far
+func (p *Pool) Status() []Status {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	result := make([]Status, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		status := Status{
+			Addr:                u.addr,
+			Healthy:             !u.ejected(now),
+			ConsecutiveFailures: u.failures,
+			RTT:                 u.rtt.String(),
+			Queries:             u.queries,
+			Failures:            u.errors,
+		}
+		if u.ejected(now) {
+			until := u.ejectedUntil
+			status.EjectedUntil = &until
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Addr < result[j].Addr })
+	return result
+}
+
+// Probe asks the ejected nameservers for the root NS records, the ones
+// answering are healthy again.
+func (p *Pool) Probe() {
+	p.lock.Lock()
+	now := time.Now()
+	ejected := []string{}
+	for _, u := range p.upstreams {
+		if u.ejected(now) {
+			ejected = append(ejected, u.addr)
+		}
+	}
+	p.lock.Unlock()
+	for _, addr := range ejected {
+		m := new(dns.Msg)
+		m.SetQuestion(".", dns.TypeNS)
+		p.exchange(m, addr)
+	}
+}
+
+// StartProbing probes the ejected nameservers every ProbeInterval until
+// StopProbing is called.
+func (p *Pool) StartProbing() {
+	p.lock.Lock()
+	if p.stop != nil {
+		p.lock.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	p.stop = stop
+	p.lock.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.Probe()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// StopProbing stops the probes started by StartProbing
+func (p *Pool) StopProbing() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
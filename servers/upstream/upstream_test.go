@@ -0,0 +1,160 @@
+package upstream
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeClient answers from the nameservers which aren't down, after their
+// delay, with their rcode.
+type fakeClient struct {
+	lock    sync.Mutex
+	down    map[string]bool
+	delay   map[string]time.Duration
+	rcode   map[string]int
+	queried []string
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{down: map[string]bool{}, delay: map[string]time.Duration{}, rcode: map[string]int{}}
+}
+
+func (c *fakeClient) Exchange(m *dns.Msg, address string) (*dns.Msg, time.Duration, error) {
+	c.lock.Lock()
+	c.queried = append(c.queried, address)
+	down, delay, rcode := c.down[address], c.delay[address], c.rcode[address]
+	c.lock.Unlock()
+	time.Sleep(delay)
+	if down {
+		return nil, delay, errors.New("timeout")
+	}
+	in := new(dns.Msg)
+	in.SetRcode(m, rcode)
+	return in, delay, nil
+}
+
+func (c *fakeClient) reset() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	queried := c.queried
+	c.queried = nil
+	return queried
+}
+
+func query() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func TestSequentialEjection(t *testing.T) {
+	client := newFakeClient()
+	client.down["a"] = true
+	pool := NewPool(client, Sequential, 1)
+	nameservers := []string{"a", "b"}
+
+	for i := 0; i < pool.MaxFails; i++ {
+		if _, attempts, err := pool.Exchange(query(), nameservers); err != nil || len(attempts) != 2 {
+			t.Fatal("Expected b to answer after a failed, got:", attempts, err)
+		}
+	}
+	client.reset()
+	if _, attempts, _ := pool.Exchange(query(), nameservers); len(attempts) != 1 || attempts[0].Addr != "b" {
+		t.Error("Expected the ejected nameserver to be skipped, got:", attempts)
+	}
+	status := pool.Status()
+	if len(status) != 2 || status[0].Healthy || status[0].ConsecutiveFailures != 3 || status[0].EjectedUntil == nil || !status[1].Healthy {
+		t.Error("Unexpected status:", status)
+	}
+
+	// ejected nameservers are still tried as a last resort
+	client.down["b"] = true
+	if _, attempts, err := pool.Exchange(query(), nameservers); err == nil || len(attempts) != 2 {
+		t.Error("Expected every nameserver to be tried, got:", attempts, err)
+	}
+
+	// a probe brings a nameserver back
+	client.down["a"] = false
+	pool.Probe()
+	if status := pool.Status(); !status[0].Healthy || status[0].ConsecutiveFailures != 0 {
+		t.Error("Expected the probe to bring a back, got:", status)
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	client := newFakeClient()
+	pool := NewPool(client, RoundRobin, 1)
+	for i := 0; i < 4; i++ {
+		pool.Exchange(query(), []string{"a", "b", "c"})
+	}
+	if queried := client.reset(); len(queried) != 4 || queried[0] != "a" || queried[1] != "b" || queried[2] != "c" || queried[3] != "a" {
+		t.Error("Unexpected order:", queried)
+	}
+}
+
+func TestLowestLatency(t *testing.T) {
+	client := newFakeClient()
+	client.delay["slow"] = 20 * time.Millisecond
+	pool := NewPool(client, LowestLatency, 1)
+	nameservers := []string{"slow", "fast"}
+
+	// measure both nameservers first
+	pool.Exchange(query(), []string{"slow"})
+	pool.Exchange(query(), []string{"fast"})
+	client.reset()
+	if _, attempts, _ := pool.Exchange(query(), nameservers); len(attempts) != 1 || attempts[0].Addr != "fast" {
+		t.Error("Expected the fastest nameserver to answer, got:", attempts)
+	}
+}
+
+func TestRace(t *testing.T) {
+	client := newFakeClient()
+	client.delay["slow"] = 200 * time.Millisecond
+	client.down["down"] = true
+	pool := NewPool(client, Race, 2)
+
+	start := time.Now()
+	in, attempts, err := pool.Exchange(query(), []string{"slow", "fast", "other"})
+	if err != nil || in == nil || attempts[0].Addr != "fast" {
+		t.Error("Expected the fastest nameserver to win, got:", attempts, err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Expected the race not to wait for the slow nameserver")
+	}
+
+	// the nameservers after the raced ones are tried when both fail
+	in, attempts, err = pool.Exchange(query(), []string{"down", "down", "fast"})
+	if err != nil || attempts[len(attempts)-1].Addr != "fast" {
+		t.Error("Expected the next nameserver to answer, got:", attempts, err)
+	}
+}
+
+func TestServerFailure(t *testing.T) {
+	client := newFakeClient()
+	client.rcode["broken"] = dns.RcodeServerFailure
+	pool := NewPool(client, LowestLatency, 1)
+	nameservers := []string{"broken", "slow"}
+	client.delay["slow"] = 10 * time.Millisecond
+
+	// the quick SERVFAIL doesn't stop the failover nor win on latency
+	for i := 0; i < pool.MaxFails; i++ {
+		in, attempts, err := pool.Exchange(query(), nameservers)
+		if err != nil || in.Rcode != dns.RcodeSuccess || attempts[len(attempts)-1].Addr != "slow" {
+			t.Fatal("Expected slow to answer after broken failed, got:", attempts, err)
+		}
+	}
+	if status := pool.Status(); status[0].Addr != "broken" || status[0].Healthy || status[0].Failures != 3 {
+		t.Error("Expected broken to be ejected, got:", status)
+	}
+
+	// the SERVFAIL comes with the error once every nameserver failed
+	client.down["slow"] = true
+	in, attempts, err := pool.Exchange(query(), nameservers)
+	if err != errAllFailed || in == nil || in.Rcode != dns.RcodeServerFailure || len(attempts) != 2 {
+		t.Error("Expected the SERVFAIL reply, got:", in, attempts, err)
+	}
+}
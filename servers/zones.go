@@ -0,0 +1,92 @@
+package servers
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hawkingrei/g53/utils"
+	"github.com/miekg/dns"
+)
+
+// ZoneListProvider represents the entrypoint to manage zones
+type ZoneListProvider interface {
+	AddZone(utils.Zone) error
+	RemoveZone(name string) error
+	GetZone(name string) (utils.Zone, bool)
+	GetAllZones() []utils.Zone
+}
+
+// zoneRegistry holds the zones g53 is authoritative for
+type zoneRegistry struct {
+	lock  sync.RWMutex
+	zones map[string]*utils.Zone
+}
+
+func newZoneRegistry() *zoneRegistry {
+	return &zoneRegistry{zones: make(map[string]*utils.Zone)}
+}
+
+// add registers a zone, replacing a zone of the same name always bumps
+// its serial.
+func (z *zoneRegistry) add(zone utils.Zone) {
+	zone.SetDefaults()
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if old, ok := z.zones[zone.Name]; ok && zone.Serial <= old.Serial {
+		zone.Serial = old.Serial + 1
+	}
+	z.zones[zone.Name] = &zone
+}
+
+func (z *zoneRegistry) remove(name string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if _, ok := z.zones[name]; !ok {
+		return errors.New("Zone doesn't exist")
+	}
+	delete(z.zones, name)
+	return nil
+}
+
+// find returns the closest zone containing name
+func (z *zoneRegistry) find(name string) (utils.Zone, bool) {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+	if zone := z.lookup(name); zone != nil {
+		return *zone, true
+	}
+	return utils.Zone{}, false
+}
+
+// touch increments the serial of the zone containing name
+func (z *zoneRegistry) touch(name string) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if zone := z.lookup(name); zone != nil {
+		zone.Serial++
+	}
+}
+
+func (z *zoneRegistry) lookup(name string) *utils.Zone {
+	name = strings.ToLower(dns.Fqdn(name))
+	for off, end := 0, false; !end; off, end = dns.NextLabel(name, off) {
+		if zone, ok := z.zones[name[off:]]; ok {
+			return zone
+		}
+	}
+	return nil
+}
+
+func (z *zoneRegistry) list() []utils.Zone {
+	z.lock.RLock()
+	defer z.lock.RUnlock()
+	result := make([]utils.Zone, 0, len(z.zones))
+	for _, zone := range z.zones {
+		result = append(result, *zone)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
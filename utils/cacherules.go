@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// CacheRule caps the TTL the answers for names below Domain are cached
+// with, a MaxTTL of 0 keeps them out of the cache.
+type CacheRule struct {
+	Domain string
+	MaxTTL time.Duration
+}
+
+// ParseCacheRule parses a rule like `cdn.example.com=60s`, or
+// `ads.example.com=0` to never cache the answers below ads.example.com.
+// TTLs are whole seconds, so other TTLs below 1s are rejected.
+func ParseCacheRule(value string) (CacheRule, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return CacheRule{}, errors.New("Cache rule '" + value + "' must be domain=ttl")
+	}
+	rule := CacheRule{Domain: strings.ToLower(strings.Trim(parts[0], " "))}
+	if rule.Domain == "" {
+		return CacheRule{}, errors.New("Cache rule '" + value + "' must be domain=ttl")
+	}
+	if !strings.HasSuffix(rule.Domain, ".") {
+		rule.Domain = rule.Domain + "."
+	}
+	ttl := strings.Trim(parts[1], " ")
+	if ttl != "0" {
+		maxTTL, err := time.ParseDuration(ttl)
+		if err != nil {
+			return CacheRule{}, err
+		}
+		if maxTTL < 0 {
+			return CacheRule{}, errors.New("Cache rule '" + value + "' has a negative TTL")
+		}
+		if maxTTL > 0 && maxTTL < time.Second {
+			return CacheRule{}, errors.New("Cache rule '" + value + "' has a TTL below 1s, use 0 to never cache")
+		}
+		rule.MaxTTL = maxTTL
+	}
+	return rule, nil
+}
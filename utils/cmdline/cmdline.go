@@ -2,6 +2,7 @@ package cmdline
 
 import (
 	"bytes"
+	"errors"
 	"github.com/hawkingrei/g53/utils"
 	"github.com/hawkingrei/g53/version"
 	"gopkg.in/alecthomas/kingpin.v2"
@@ -42,10 +43,39 @@ func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Conf
 	app.Version(VERSION)
 	app.HelpFlag.Short('h')
 
-	nameservers := app.Flag("nameserver", "Comma separated list of DNS server(s) for unmatched requests").Default("8.8.8.8:53,8.8.4.4:53").String()
+	nameservers := app.Flag("nameserver", "Comma separated list of DNS server(s) for unmatched requests, e.g. 8.8.8.8:53, tcp://8.8.8.8, tls://9.9.9.9:853#dns.quad9.net or https://dns.google/dns-query?timeout=2s").Default("8.8.8.8:53,8.8.4.4:53").String()
+	forwarders := app.Flag("forward", "Forward the requests below a domain to other DNS server(s), e.g. consul=127.0.0.1:8600, can be repeated").Strings()
+	strategy := app.Flag("upstream-strategy", "Order DNS servers are tried in: sequential, round-robin, lowest-latency or race").Default(res.UpstreamStrategy).Enum("sequential", "round-robin", "lowest-latency", "race")
+	race := app.Flag("upstream-race", "Number of DNS servers queried at once by the race strategy").Default(strconv.Itoa(res.UpstreamRace)).Int()
+	timeout := app.Flag("upstream-timeout", "Timeout of the queries to DNS servers without a timeout of their own").Default(res.UpstreamTimeout.String()).Duration()
+	serveStale := app.Flag("serve-stale", "Keep expired answers this long to serve them when the DNS servers fail, e.g. 24h").Default(res.ServeStale.String()).Duration()
+	staleTTL := app.Flag("stale-ttl", "TTL of the expired answers served").Default(res.StaleTTL.String()).Duration()
+	staleTimeout := app.Flag("stale-answer-timeout", "Serve expired answers when the DNS servers take longer to answer, 0 waits for them").Default(res.StaleAnswerTimeout.String()).Duration()
+	prefetch := app.Flag("prefetch", "Refresh cached answers looked up in the last percent of their TTL, 0 disables it").Default(strconv.Itoa(res.PrefetchPercent)).Int()
+	prefetchHits := app.Flag("prefetch-hits", "Only refresh cached answers looked up at least this many times").Default(strconv.Itoa(res.PrefetchHits)).Int()
+	maxNegativeTTL := app.Flag("max-negative-ttl", "Cache NXDOMAIN and NODATA answers at most this long, 0 disables it").Default(res.MaxNegativeTTL.String()).Duration()
+	cacheSize := app.Flag("cache-size", "Number of answers the cache holds").Default(strconv.Itoa(res.CacheSize)).Int()
+	cacheMemory := app.Flag("cache-memory", "Size the answers of the cache take at most in wire format, e.g. 32MB, 0 only bounds their number").Default(strconv.FormatInt(res.CacheMemory, 10)).Bytes()
+	cacheShards := app.Flag("cache-shards", "Number of independently locked parts the cache is split into").Default(strconv.Itoa(res.CacheShards)).Int()
+	cachePolicy := app.Flag("cache-policy", "Policy picking the answers evicted from the cache: lru, or 2q and arc which resist scans").Default(res.CachePolicy).Enum("lru", "2q", "arc")
+	cacheMinTTL := app.Flag("cache-min-ttl", "Cache answers at least this long, 0 keeps their TTL").Default(res.CacheMinTTL.String()).Duration()
+	cacheMaxTTL := app.Flag("cache-max-ttl", "Cache answers at most this long, 0 keeps their TTL").Default(res.CacheMaxTTL.String()).Duration()
+	cacheRules := app.Flag("cache-rule", "Cache the answers below a domain at most this long, 0 never caches them, e.g. cdn.example.com=60s, can be repeated").Strings()
+	cacheSweep := app.Flag("cache-sweep-interval", "Remove a batch of expired answers from the cache this often, 0 only removes them when they are looked up").Default(res.CacheSweepInterval.String()).Duration()
+	cacheFile := app.Flag("cache-file", "Save the cache into this file on shutdown and periodically, and load it on startup").Default(res.CacheFile).String()
+	cacheSave := app.Flag("cache-save-interval", "Save the cache into the cache file this often, 0 only saves it on shutdown").Default(res.CacheSaveInterval.String()).Duration()
 	dns := app.Flag("dns", "Listen DNS requests on this address").Default(res.DnsAddr).Short('d').String()
+	tcpIdle := app.Flag("tcp-idle-timeout", "Close idle DNS over TCP connections after this duration").Default(res.TcpIdleTimeout.String()).Duration()
+	tlsAddr := app.Flag("tls", "Listen DNS over TLS requests on this address, e.g. :853").Default(res.TlsAddr).String()
+	tlsCert := app.Flag("tlscert", "Certificate of the DNS over TLS listener, reloaded when the file changes").Default(res.TlsCert).String()
+	tlsKey := app.Flag("tlskey", "Private key of the DNS over TLS listener").Default(res.TlsKey).String()
+	tlsCaCert := app.Flag("tlscacert", "CA certificates of the DNS over TLS clients").Default(res.TlsCaCert).String()
+	tlsVerify := app.Flag("tlsverify", "Require DNS over TLS clients to present a certificate signed by tlscacert").Default(strconv.FormatBool(res.TlsVerify)).Bool()
 	http := app.Flag("http", "Listen HTTP requests on this address").Default(res.HttpAddr).Default(":80").String()
+	https := app.Flag("https", "Listen HTTPS requests, e.g. DNS over HTTPS queries, on this address with the TLS certificate").Default(res.HttpsAddr).String()
 	ttl := app.Flag("ttl", "TTL for matched requests").Default(strconv.FormatInt(int64(res.Ttl), 10)).Int()
+	reverse := app.Flag("reverse-cidr", "Comma separated list of networks whose reverse zones are answered locally").Default("").String()
+	nsAddress := app.Flag("ns-address", "Comma separated list of addresses the NS records of the zones point at, defaults to the address of --dns unless it is a wildcard").Default("").String()
 
 	verbose := app.Flag("verbose", "Verbose mode.").Default(strconv.FormatBool(res.Verbose)).Short('v').Bool()
 	quiet := app.Flag("quiet", "Quiet mode.").Default(strconv.FormatBool(res.Quiet)).Short('q').Bool()
@@ -54,8 +84,54 @@ func (cmdline *CommandLine) ParseParameters(rawParams []string) (res *utils.Conf
 	res.Verbose = *verbose
 	res.Quiet = *quiet
 	res.Nameservers = strings.Split(*nameservers, ",")
+	res.UpstreamStrategy = *strategy
+	res.UpstreamRace = *race
+	res.UpstreamTimeout = *timeout
+	res.ServeStale = *serveStale
+	res.StaleTTL = *staleTTL
+	res.StaleAnswerTimeout = *staleTimeout
+	res.PrefetchPercent = *prefetch
+	res.PrefetchHits = *prefetchHits
+	res.MaxNegativeTTL = *maxNegativeTTL
+	res.CacheSize = *cacheSize
+	res.CacheMemory = int64(*cacheMemory)
+	res.CacheShards = *cacheShards
+	res.CachePolicy = *cachePolicy
+	res.CacheMinTTL = *cacheMinTTL
+	res.CacheMaxTTL = *cacheMaxTTL
+	res.CacheSweepInterval = *cacheSweep
+	res.CacheFile = *cacheFile
+	res.CacheSaveInterval = *cacheSave
 	res.DnsAddr = *dns
+	res.TcpIdleTimeout = *tcpIdle
+	res.TlsAddr = *tlsAddr
+	res.TlsCert = *tlsCert
+	res.TlsKey = *tlsKey
+	res.TlsCaCert = *tlsCaCert
+	res.TlsVerify = *tlsVerify
 	res.HttpAddr = *http
+	res.HttpsAddr = *https
 	res.Ttl = *ttl
+	for _, value := range *forwarders {
+		forwarder, err := utils.ParseForwarder(value)
+		if err != nil {
+			return nil, err
+		}
+		res.Forwarders = append(res.Forwarders, forwarder)
+	}
+	for _, value := range *cacheRules {
+		rule, err := utils.ParseCacheRule(value)
+		if err != nil {
+			return nil, err
+		}
+		res.CacheRules = append(res.CacheRules, rule)
+	}
+	if res.CacheSize < res.CacheShards || res.CacheShards <= 0 {
+		return nil, errors.New("--cache-size must be at least --cache-shards, which must be positive")
+	}
+	if err = res.NsAddresses.Set(*nsAddress); err != nil {
+		return nil, err
+	}
+	err = res.ReverseCIDRs.Set(*reverse)
 	return
 }
@@ -1,7 +1,10 @@
 package utils
 
 import (
+	"errors"
+	"net"
 	"strings"
+	"time"
 )
 
 // Domain represents a domain
@@ -41,28 +44,128 @@ func (n *nameservers) Set(value string) error {
 	return nil
 }
 
+// cidrs is a list of networks parsed from a comma separated string
+type cidrs []*net.IPNet
+
+func (c *cidrs) String() string {
+	result := make([]string, len(*c))
+	for i := range *c {
+		result[i] = (*c)[i].String()
+	}
+	return strings.Join(result, ",")
+}
+
+// Set parses a comma separated list of networks in CIDR notation
+func (c *cidrs) Set(value string) error {
+	*c = nil
+	for _, cidr := range strings.Split(value, ",") {
+		cidr = strings.Trim(cidr, " ")
+		if cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		*c = append(*c, network)
+	}
+	return nil
+}
+
+// ips is a list of addresses parsed from a comma separated string
+type ips []net.IP
+
+func (i *ips) String() string {
+	result := make([]string, len(*i))
+	for n := range *i {
+		result[n] = (*i)[n].String()
+	}
+	return strings.Join(result, ",")
+}
+
+// Set parses a comma separated list of IPv4 and IPv6 addresses
+func (i *ips) Set(value string) error {
+	*i = nil
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.Trim(addr, " ")
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return errors.New("Address '" + addr + "' is not an IP address")
+		}
+		*i = append(*i, ip)
+	}
+	return nil
+}
+
 // Config contains DNSDock configuration
 type Config struct {
-	Nameservers nameservers
-	DnsAddr     string
-	Domain      Domain
-	TlsVerify   bool
-	TlsCaCert   string
-	TlsCert     string
-	TlsKey      string
-	HttpAddr    string
-	Ttl         int
-	CreateAlias bool
-	Verbose     bool
-	Quiet       bool
+	Nameservers        nameservers
+	Forwarders         []Forwarder
+	UpstreamStrategy   string
+	UpstreamRace       int
+	UpstreamTimeout    time.Duration
+	ServeStale         time.Duration
+	StaleTTL           time.Duration
+	StaleAnswerTimeout time.Duration
+	PrefetchHits       int
+	PrefetchPercent    int
+	MaxNegativeTTL     time.Duration
+	CacheSize          int
+	CacheMemory        int64
+	CacheShards        int
+	CachePolicy        string
+	CacheMinTTL        time.Duration
+	CacheMaxTTL        time.Duration
+	CacheRules         []CacheRule
+	CacheSweepInterval time.Duration
+	CacheFile          string
+	CacheSaveInterval  time.Duration
+	DnsAddr            string
+	TcpIdleTimeout     time.Duration
+	Domain             Domain
+	ReverseCIDRs       cidrs
+	NsAddresses        ips
+	TlsAddr            string
+	TlsVerify          bool
+	TlsCaCert          string
+	TlsCert            string
+	TlsKey             string
+	HttpAddr           string
+	HttpsAddr          string
+	Ttl                int
+	CreateAlias        bool
+	Verbose            bool
+	Quiet              bool
 }
 
 // NewConfig creates a new config
 func NewConfig() *Config {
 	return &Config{
 		Nameservers: nameservers{"8.8.4.4:53", "8.8.8.8:53"},
-		DnsAddr:     ":53",
-		Domain:      NewDomain("suphawking.com"),
+		// Nameservers are tried in order, like resolv.conf does
+		UpstreamStrategy: "sequential",
+		UpstreamRace:     2,
+		UpstreamTimeout:  5 * time.Second,
+		// RFC 8767 recommends a TTL of 30s and a client response timer of
+		// 1.8s for stale answers
+		StaleTTL:           30 * time.Second,
+		StaleAnswerTimeout: 1800 * time.Millisecond,
+		PrefetchHits:       10,
+		// RFC 2308 recommends caching negative answers for at most 1 to 3 hours
+		MaxNegativeTTL: time.Hour,
+		CacheSize:      65536,
+		CacheShards:    256,
+		CachePolicy:    "lru",
+		// every sweep looks at 64 answers per shard
+		CacheSweepInterval: 10 * time.Second,
+		CacheSaveInterval:  5 * time.Minute,
+		DnsAddr:            ":53",
+		// RFC 7766 recommends an idle timeout in the order of seconds
+		TcpIdleTimeout: 10 * time.Second,
+		Domain:         NewDomain("suphawking.com"),
 		//DockerHost:  dockerHost,
 		HttpAddr:    ":80",
 		CreateAlias: false,
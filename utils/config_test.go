@@ -3,6 +3,7 @@ package utils
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDomainCreation(t *testing.T) {
@@ -44,3 +45,64 @@ func TestNameserverSet(t *testing.T) {
 	ns := NewConfig().Nameservers.Set("8.8.4.4:53")
 	t.Log(ns)
 }
+
+func TestReverseCIDRs(t *testing.T) {
+	config := NewConfig()
+	if err := config.ReverseCIDRs.Set("10.0.0.0/8, fd00::/8"); err != nil {
+		t.Error(err)
+	}
+	if config.ReverseCIDRs.String() != "10.0.0.0/8,fd00::/8" {
+		t.Error("Expected: 10.0.0.0/8,fd00::/8 Got:", config.ReverseCIDRs.String())
+	}
+	if err := config.ReverseCIDRs.Set("10.0.0.0/33"); err == nil {
+		t.Error("Invalid network should fail")
+	}
+}
+
+func TestNsAddresses(t *testing.T) {
+	config := NewConfig()
+	if err := config.NsAddresses.Set("192.0.2.53, 2001:db8::53"); err != nil {
+		t.Error(err)
+	}
+	if config.NsAddresses.String() != "192.0.2.53,2001:db8::53" {
+		t.Error("Expected: 192.0.2.53,2001:db8::53 Got:", config.NsAddresses.String())
+	}
+	if err := config.NsAddresses.Set("ns.example.com"); err == nil {
+		t.Error("Invalid address should fail")
+	}
+}
+
+func TestParseForwarder(t *testing.T) {
+	forwarder, err := ParseForwarder("Corp.Example.com=10.0.0.53, 10.0.0.54:5353,[fd00::53]:53,tls://9.9.9.9#dns.quad9.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Forwarder{Domain: "corp.example.com.", Nameservers: []string{"10.0.0.53:53", "10.0.0.54:5353", "[fd00::53]:53", "tls://9.9.9.9#dns.quad9.net"}}
+	if !reflect.DeepEqual(forwarder, expected) {
+		t.Error("Expected:", expected, "Got:", forwarder)
+	}
+	for _, input := range []string{"consul", "=127.0.0.1", "consul=", "consul=ns.example.com:53"} {
+		if _, err := ParseForwarder(input); err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
+
+func TestParseCacheRule(t *testing.T) {
+	var tests = map[string]CacheRule{
+		"CDN.example.com=60s": {Domain: "cdn.example.com.", MaxTTL: 60 * time.Second},
+		"ads.example.com.=0":  {Domain: "ads.example.com."},
+		"ads.example.com=0s":  {Domain: "ads.example.com."},
+	}
+	for input, expected := range tests {
+		rule, err := ParseCacheRule(input)
+		if err != nil || rule != expected {
+			t.Error(input, "Expected:", expected, "Got:", rule, err)
+		}
+	}
+	for _, input := range []string{"cdn.example.com", "=60s", "cdn.example.com=60", "cdn.example.com=-1s", "cdn.example.com=500ms"} {
+		if _, err := ParseCacheRule(input); err == nil {
+			t.Error(input, "should fail")
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Forwarder sends the queries for names below Domain to its own
+// nameservers instead of the default ones.
+type Forwarder struct {
+	Domain      string
+	Nameservers []string
+}
+
+// ParseForwarder parses a rule like `corp.example.com=10.0.0.53,10.0.0.54`
+func ParseForwarder(value string) (Forwarder, error) {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return Forwarder{}, errors.New("Forwarder '" + value + "' must be domain=nameserver[,nameserver]")
+	}
+	forwarder := Forwarder{Domain: strings.Trim(parts[0], " ")}
+	for _, ns := range strings.Split(parts[1], ",") {
+		forwarder.Nameservers = append(forwarder.Nameservers, strings.Trim(ns, " "))
+	}
+	return forwarder, forwarder.SetDefaults()
+}
+
+// SetDefaults normalizes the domain and the nameservers, plain IP addresses
+// use port 53 unless they have their own. Entries with a scheme, like
+// `tls://9.9.9.9:853`, are kept as they are.
+func (f *Forwarder) SetDefaults() error {
+	f.Domain = strings.ToLower(strings.Trim(f.Domain, " "))
+	if f.Domain == "" {
+		return errors.New("Property \"Domain\" is required")
+	}
+	if !strings.HasSuffix(f.Domain, ".") {
+		f.Domain = f.Domain + "."
+	}
+	if len(f.Nameservers) == 0 {
+		return errors.New("Property \"Nameservers\" is required")
+	}
+	for i, ns := range f.Nameservers {
+		if strings.Contains(ns, "://") {
+			continue
+		}
+		if net.ParseIP(ns) != nil {
+			ns = net.JoinHostPort(ns, "53")
+		}
+		host, _, err := net.SplitHostPort(ns)
+		if err != nil {
+			return err
+		}
+		if net.ParseIP(host) == nil {
+			return errors.New("Nameserver '" + ns + "' is not an IP address")
+		}
+		f.Nameservers[i] = ns
+	}
+	return nil
+}
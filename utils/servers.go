@@ -6,11 +6,18 @@ import (
 
 // Service represents a container and an attached DNS record
 // service(recode_type: "A",value: []string{"127.0.0.1","127.0.0.1"},Aliases: "www.duitang.net" ))
+// MX records use Preference and Target, SRV records use Priority, Weight,
+// Port and Target. For both of them Value mirrors Target.
 type Service struct {
 	RecordType string
 	Value      string
 	TTL        int
 	Aliases    string
+	Preference int    `json:",omitempty"`
+	Priority   int    `json:",omitempty"`
+	Weight     int    `json:",omitempty"`
+	Port       int    `json:",omitempty"`
+	Target     string `json:",omitempty"`
 }
 
 type Entry struct {
@@ -18,15 +25,46 @@ type Entry struct {
 	Value      string
 	TTL        int
 	Aliases    string
+	Preference int
+	Priority   int
+	Weight     int
+	Port       int
+	Target     string
 	Time       time.Time
 }
 
+// NewEntry creates the stored form of a service
+func NewEntry(s Service) *Entry {
+	return &Entry{
+		RecordType: s.RecordType,
+		Value:      s.Value,
+		TTL:        s.TTL,
+		Aliases:    s.Aliases,
+		Preference: s.Preference,
+		Priority:   s.Priority,
+		Weight:     s.Weight,
+		Port:       s.Port,
+		Target:     s.Target,
+		Time:       time.Now(),
+	}
+}
+
 func EntryToServer(s *Entry) Service {
-	return Service{(*s).RecordType, (*s).Value, (*s).TTL, (*s).Aliases}
+	return Service{
+		RecordType: s.RecordType,
+		Value:      s.Value,
+		TTL:        s.TTL,
+		Aliases:    s.Aliases,
+		Preference: s.Preference,
+		Priority:   s.Priority,
+		Weight:     s.Weight,
+		Port:       s.Port,
+		Target:     s.Target,
+	}
 }
 
 func entryToServer(s Entry) Service {
-	return Service{s.RecordType, s.Value, s.TTL, s.Aliases}
+	return EntryToServer(&s)
 }
 func BatchEntryToServer(s *[]Entry) []Service {
 	result := []Service{}
@@ -36,5 +74,5 @@ func BatchEntryToServer(s *[]Entry) []Service {
 	return result
 }
 func EntryPointerToEntry(s *Entry) Entry {
-	return Entry{(*s).RecordType, (*s).Value, (*s).TTL, (*s).Aliases, (*s).Time}
+	return *s
 }
@@ -0,0 +1,53 @@
+package utils
+
+import (
+	"strings"
+	"time"
+)
+
+// Zone represents a zone g53 is authoritative for, with the fields of its
+// SOA record. A zero Ttl or Minttl falls back to the global TTL.
+type Zone struct {
+	Name    string
+	Ns      string
+	Mbox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minttl  uint32
+	Ttl     int
+}
+
+// NewZone creates a zone with the default SOA values
+func NewZone(name string) Zone {
+	zone := Zone{Name: name}
+	zone.SetDefaults()
+	return zone
+}
+
+// SetDefaults normalizes the zone name and fills the unset SOA fields
+func (z *Zone) SetDefaults() {
+	z.Name = strings.ToLower(z.Name)
+	if !strings.HasSuffix(z.Name, ".") {
+		z.Name = z.Name + "."
+	}
+	if z.Ns == "" {
+		z.Ns = "g53." + z.Name
+	}
+	if z.Mbox == "" {
+		z.Mbox = "g53.g53." + z.Name
+	}
+	if z.Serial == 0 {
+		z.Serial = uint32(time.Now().Unix())
+	}
+	if z.Refresh == 0 {
+		z.Refresh = 28800
+	}
+	if z.Retry == 0 {
+		z.Retry = 7200
+	}
+	if z.Expire == 0 {
+		z.Expire = 604800
+	}
+}